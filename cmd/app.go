@@ -2,22 +2,24 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 
+	"github.com/rbnhln/smi2mqtt/internal/config"
 	"github.com/rbnhln/smi2mqtt/internal/gpuinfo"
-	"github.com/rbnhln/smi2mqtt/internal/homeassistant"
+	"github.com/rbnhln/smi2mqtt/internal/mqtt"
 )
 
-type GpuPublishedState struct {
-	State     gpuinfo.GpuState
-	Timestamp time.Time
-}
+const (
+	minDriverBackoff = 2 * time.Second
+	maxDriverBackoff = 60 * time.Second
+
+	statusWaitingForDriver = "waiting_for_driver"
+	statusRunning          = "running"
+)
 
 func (app *application) serve() error {
 	// MQTT Connect
@@ -27,103 +29,45 @@ func (app *application) serve() error {
 	}
 	defer app.mqttClient.Disconnect()
 	app.logger.Info("successfully connected to mqtt broker")
-
-	// Check GPUs
-	listGpus, err := gpuinfo.GetGpuInfo()
-	if err != nil {
-		return fmt.Errorf("failed to find nvidia gpus: %w", err)
-	}
-	if len(listGpus) == 0 {
-		return fmt.Errorf("found 0 nvidia gpus")
-	}
-
-	// MQTT HA Auto-Discovery
-	if app.config.HA {
-		app.logger.Info("publishing home assistant auto-discovery configs")
-		err := homeassistant.PublishConfigs(app.mqttClient, listGpus, app.config.Topic)
-		if err != nil {
-			app.logger.Warn("failed to publish HA discovery configs", "error", err)
-		}
-	}
+	// The will only covers lost connections, a clean shutdown resets the
+	// status itself before disconnecting.
+	defer app.publishStatus(mqtt.StatusOffline)
 
 	// Create context for clean shutdown of goroutines
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	mergedStateChan := make(chan gpuinfo.GpuState)
-	var forwarderWg sync.WaitGroup
-
-	for _, gpu := range listGpus {
-		currentGpu := gpu
-
-		stateChan, err := gpuinfo.CombinedMonitor(
-			ctx,
-			app.logger,
-			currentGpu,
-			app.config.DmonInterval,
-			time.Duration(app.config.QueryInterval)*time.Second,
-		)
-		if err != nil {
-			app.logger.Error("failed to start combined monitor for gpu", "gpu_id", currentGpu.Index, "error", err)
-			continue
-		}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-quit
+		app.logger.Info("caught signal", "signal", s.String())
+		cancel()
+	}()
 
-		forwarderWg.Add(1)
-		app.background(func() {
-			defer forwarderWg.Done()
-			for state := range stateChan {
-				select {
-				case mergedStateChan <- state:
-				case <-ctx.Done():
-					app.logger.Debug("forwarder context cancelled", "gpu_uuid", currentGpu.Uuid)
-					return
-				}
-			}
-			app.logger.Debug("forwarder finished", "gpu_uuid", currentGpu.Uuid)
-		})
+	// Check GPUs
+	listGpus, err := app.findGpus(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
 	}
 
-	go func() {
-		forwarderWg.Wait()
-		close(mergedStateChan)
-		app.logger.Debug("all forwarders finished, closed merged channel")
-	}()
+	// MQTT HA Auto-Discovery
+	app.publishDiscovery(listGpus)
 
+	stateChan := make(chan gpuinfo.GpuState)
 	app.background(func() {
-		app.logger.Info("starting main metrics consumer")
-		lastPublished := make(map[string]GpuPublishedState)
-		forcePublishInterval := 30 * time.Second
-
-		for state := range mergedStateChan {
-			uuid := state.Gpu.Uuid
-			lastState, found := lastPublished[uuid]
-			if !found || state != lastState.State || time.Since(lastState.Timestamp) > forcePublishInterval {
-				payload, err := json.Marshal(state)
-				if err != nil {
-					app.logger.Error("failed to marshal metrics", "gpu_uuid", state.Gpu.Uuid, "error", err)
-					continue
-				}
-
-				topic := fmt.Sprintf("%s/%s/state", app.config.Topic, state.Gpu.Uuid)
-				if err := app.mqttClient.Publish(string(payload), topic, false); err != nil {
-					app.logger.Error("failed to publish metrics", "gpu_uuid", state.Gpu.Uuid, "error", err)
-				}
-
-				lastPublished[uuid] = GpuPublishedState{
-					State:     state,
-					Timestamp: time.Now(),
-				}
-			}
-		}
-		app.logger.Info("main metrics consumer stopped")
+		app.runMonitors(ctx, listGpus, stateChan)
 	})
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	s := <-quit
-	app.logger.Info("caught signal", "signal", s.String())
+	app.background(func() {
+		app.consumeStates(stateChan)
+	})
+
+	<-ctx.Done()
 	app.logger.Info("shutting down")
-	cancel()
 
 	// Graceful shutdown with timeout
 	done := make(chan struct{})
@@ -140,3 +84,48 @@ func (app *application) serve() error {
 	}
 	return nil
 }
+
+// findGpus enumerates the GPUs. In wait startup mode it retries with backoff
+// until GPUs show up, e.g. while the NVIDIA kernel module is still loading.
+func (app *application) findGpus(ctx context.Context) ([]gpuinfo.GPU, error) {
+	backoff := minDriverBackoff
+	waiting := false
+
+	for {
+		gpus, err := app.collector.GetGpuInfo(ctx)
+		if err == nil && len(gpus) == 0 {
+			err = fmt.Errorf("found 0 nvidia gpus")
+		}
+		if err == nil {
+			if waiting {
+				app.logger.Info("nvidia driver is ready", "gpus", len(gpus))
+			}
+			app.publishStatus(statusRunning)
+			return gpus, nil
+		}
+
+		if app.config.StartupMode != config.StartupModeWait {
+			return nil, fmt.Errorf("failed to find nvidia gpus: %w", err)
+		}
+		if !waiting {
+			waiting = true
+			app.publishStatus(statusWaitingForDriver)
+		}
+		app.logger.Warn("waiting for nvidia driver", "error", err, "retry_in", backoff)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxDriverBackoff)
+	}
+}
+
+// publishStatus publishes the service status as retained message.
+func (app *application) publishStatus(status string) {
+	topic := fmt.Sprintf("%s/status", app.config.Topic)
+	if err := app.mqttClient.Publish(status, topic, true); err != nil {
+		app.logger.Warn("failed to publish status", "status", status, "error", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rbnhln/smi2mqtt/internal/gpuinfo"
+)
+
+// Event severities.
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// Event is a notable condition published to <topic>/events.
+type Event struct {
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	GpuUuid   string    `json:"gpu_uuid,omitempty"`
+	GpuName   string    `json:"gpu_name,omitempty"`
+	Xid       int       `json:"xid,omitempty"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// publishEvent publishes event to the non-retained events topic.
+func (app *application) publishEvent(event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		app.logger.Error("failed to marshal event", "type", event.Type, "error", err)
+		return
+	}
+
+	topic := fmt.Sprintf("%s/events", app.config.Topic)
+	if err := app.mqttClient.Publish(string(payload), topic, false); err != nil {
+		app.logger.Error("failed to publish event", "type", event.Type, "error", err)
+	}
+}
+
+// publishAvailability publishes whether the entities of a GPU are available.
+func (app *application) publishAvailability(gpu gpuinfo.GPU, online bool) {
+	status := "offline"
+	if online {
+		status = "online"
+	}
+
+	topic := fmt.Sprintf("%s/%s/availability", app.config.Topic, gpu.Uuid)
+	if err := app.mqttClient.Publish(status, topic, true); err != nil {
+		app.logger.Warn("failed to publish gpu availability", "gpu_uuid", gpu.Uuid, "error", err)
+	}
+}
+
+// healthChanged publishes the availability of a GPU whose health changed
+// and a health event, critical for fatal conditions.
+func (app *application) healthChanged(state gpuinfo.GpuState, previous gpuinfo.Health) {
+	app.publishAvailability(state.Gpu, !state.Health.Fatal())
+	if !state.Health.Fatal() && !previous.Fatal() {
+		return
+	}
+
+	event := Event{
+		Type:      "health",
+		Severity:  severityInfo,
+		GpuUuid:   state.Gpu.Uuid,
+		GpuName:   state.Gpu.Name,
+		Message:   fmt.Sprintf("gpu recovered from %s", previous),
+		Timestamp: time.Now(),
+	}
+	if state.Health.Fatal() {
+		event.Severity = severityCritical
+		event.Message = string(state.Health)
+		if state.Error != nil {
+			event.Message = fmt.Sprintf("%s: %s", state.Health, state.Error.Message)
+		}
+		app.logger.Error("gpu health is critical", "gpu_uuid", state.Gpu.Uuid, "health", state.Health)
+	} else {
+		app.logger.Info("gpu health recovered", "gpu_uuid", state.Gpu.Uuid, "previous", previous)
+	}
+	app.publishEvent(event)
+}
+
+// memoryHealthChanged publishes a memory health event once the memory health
+// of a GPU leaves or returns to ok. The first reading is only reported if it
+// is not ok.
+func (app *application) memoryHealthChanged(state gpuinfo.GpuState, previous *gpuinfo.MemoryHealth) {
+	previousState := gpuinfo.MemoryHealthOK
+	if previous != nil {
+		previousState = previous.State
+	}
+	if state.Memory.State == previousState {
+		return
+	}
+
+	event := Event{
+		Type:      "memory_health",
+		Severity:  severityInfo,
+		GpuUuid:   state.Gpu.Uuid,
+		GpuName:   state.Gpu.Name,
+		Message:   fmt.Sprintf("memory health changed from %s to %s", previousState, state.Memory.State),
+		Timestamp: time.Now(),
+	}
+	if state.Memory.State != gpuinfo.MemoryHealthOK {
+		event.Severity = severityCritical
+		app.logger.Error("gpu memory health is critical", "gpu_uuid", state.Gpu.Uuid, "memory_health", state.Memory.State)
+	}
+	app.publishEvent(event)
+}
+
+// pcieLinkChanged publishes a pcie_link event once the PCIe link of a GPU
+// is found degraded under load or recovered. A healthy first verdict is not
+// reported.
+func (app *application) pcieLinkChanged(state gpuinfo.GpuState, previous *bool) {
+	degraded := *state.PcieLinkDegraded
+	if previous == nil && !degraded {
+		return
+	}
+
+	event := Event{
+		Type:      "pcie_link",
+		Severity:  severityInfo,
+		GpuUuid:   state.Gpu.Uuid,
+		GpuName:   state.Gpu.Name,
+		Message:   "pcie link recovered",
+		Timestamp: time.Now(),
+	}
+	if degraded {
+		query := state.QueryMetrics
+		event.Severity = severityWarning
+		event.Message = fmt.Sprintf("pcie link degraded under load: gen %s/%s, width x%s/x%s",
+			formatValue(query["pcie_link_gen_current"]), formatValue(query["pcie_link_gen_max"]),
+			formatValue(query["pcie_link_width_current"]), formatValue(query["pcie_link_width_max"]))
+		app.logger.Warn("gpu pcie link degraded", "gpu_uuid", state.Gpu.Uuid, "message", event.Message)
+	} else {
+		app.logger.Info("gpu pcie link recovered", "gpu_uuid", state.Gpu.Uuid)
+	}
+	app.publishEvent(event)
+}
+
+// formatValue renders v for messages, "?" if it has no reading.
+func formatValue(v gpuinfo.Value) string {
+	data, err := v.MarshalJSON()
+	if err != nil || !v.Valid() {
+		return "?"
+	}
+	return string(data)
+}
+
+// publishXid publishes the last Xid error of a GPU as event, critical for
+// Xids that point to failing hardware.
+func (app *application) publishXid(state gpuinfo.GpuState) {
+	xid := state.Xid.Last
+	event := Event{
+		Type:      "xid",
+		Severity:  severityWarning,
+		GpuUuid:   state.Gpu.Uuid,
+		GpuName:   state.Gpu.Name,
+		Xid:       xid.Code,
+		Message:   fmt.Sprintf("xid %d: %s", xid.Code, xid.Description),
+		Timestamp: xid.Timestamp,
+	}
+	if xid.Message != "" {
+		event.Message = fmt.Sprintf("%s: %s", event.Message, xid.Message)
+	}
+	if xid.Critical() {
+		event.Severity = severityCritical
+	}
+	app.publishEvent(event)
+}
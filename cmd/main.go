@@ -6,8 +6,10 @@ import (
 	"log/slog"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/rbnhln/smi2mqtt/internal/config"
+	"github.com/rbnhln/smi2mqtt/internal/gpuinfo"
 	"github.com/rbnhln/smi2mqtt/internal/mqtt"
 	"github.com/rbnhln/smi2mqtt/internal/vcs"
 )
@@ -19,7 +21,8 @@ var (
 type application struct {
 	config     config.Config
 	logger     *slog.Logger
-	mqttClient *mqtt.MqttClient
+	mqttClient mqtt.Client
+	collector  gpuinfo.Collector
 	wg         sync.WaitGroup
 }
 
@@ -83,10 +86,42 @@ func main() {
 		os.Exit(1)
 	}
 
+	collector := gpuinfo.NewNvidiaSmi(gpuinfo.ExecRunner{}, logger, gpuinfo.Options{
+		Path:                 cfg.NvidiaSmiPath,
+		DmonInterval:         cfg.DmonInterval,
+		DmonStallFactor:      cfg.DmonStallFactor,
+		QueryInterval:        cfg.QueryPeriod(),
+		QueryMode:            cfg.QueryMode,
+		QueryFields:          cfg.AllQueryFields(),
+		DmonGroups:           cfg.DmonGroups,
+		SnapshotInterval:     time.Duration(cfg.SnapshotInterval) * time.Second,
+		MemoryHealthInterval: time.Duration(cfg.MemoryHealthInterval) * time.Second,
+		CommandTimeout:       time.Duration(cfg.CommandTimeout) * time.Second,
+		PublishInterval:      time.Duration(cfg.PublishInterval) * time.Second,
+		Reduction:            cfg.PublishReduction,
+		StatsWindow:          time.Duration(cfg.StatsWindow) * time.Second,
+		StatsPercentile:      cfg.StatsP95,
+		DmonTimestamps:       cfg.DmonTimestamps,
+		AdaptivePolling:      cfg.AdaptivePolling,
+		IdleThreshold:        cfg.IdleThreshold,
+		IdleAfter:            time.Duration(cfg.IdleAfter) * time.Second,
+		IdleDmonInterval:     cfg.IdleDmonInterval,
+		IdleQueryInterval:    time.Duration(cfg.IdleQueryInterval) * time.Second,
+		QueryGroups:          cfg.AllMetricGroups(),
+		RuntimePM:            cfg.RuntimePM,
+		SysfsRoot:            cfg.SysfsRoot,
+		PcieLink:             cfg.PcieLink,
+		PcieDegradedLoad:     cfg.PcieDegradedLoad,
+		PcieDegradedAfter:    time.Duration(cfg.PcieDegradedAfter) * time.Second,
+		PowerLimitPercent:    cfg.PowerLimits,
+		XidLog:               cfg.XidLogPath(),
+	})
+
 	app := &application{
 		config:     *cfg,
 		logger:     logger,
 		mqttClient: mqttClient,
+		collector:  collector,
 	}
 
 	err = app.serve()
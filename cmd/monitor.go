@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/rbnhln/smi2mqtt/internal/gpuinfo"
+	"github.com/rbnhln/smi2mqtt/internal/homeassistant"
+)
+
+type GpuPublishedState struct {
+	State     gpuinfo.GpuState
+	Timestamp time.Time
+	Seq       uint64
+}
+
+// statePayload is the published state with its publish time and a per-GPU
+// sequence number, which lets consumers detect lost messages.
+type statePayload struct {
+	gpuinfo.GpuState
+	PublishedAt time.Time `json:"published_at"`
+	Seq         uint64    `json:"seq"`
+}
+
+// runMonitors keeps a combined monitor running for gpus and forwards its
+// states to out. With a rescan interval the GPUs are re-enumerated
+// periodically and the monitor is restarted whenever the set changed.
+func (app *application) runMonitors(ctx context.Context, gpus []gpuinfo.GPU, out chan<- gpuinfo.GpuState) {
+	defer close(out)
+
+	stop := app.startMonitor(ctx, gpus, out)
+	defer func() { stop() }()
+
+	if app.config.RescanInterval <= 0 {
+		<-ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(app.config.RescanInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Enumerating the GPUs would wake the suspended ones.
+			if suspended := app.collector.SuspendedGpus(gpus); len(suspended) > 0 {
+				app.logger.Debug("skipping rescan while gpus are suspended", "suspended", len(suspended))
+				continue
+			}
+			current, err := app.collector.GetGpuInfo(ctx)
+			if err != nil {
+				app.logger.Warn("failed to re-enumerate gpus", "error", err)
+				continue
+			}
+			// Any change restarts the monitor, as dmon lines are matched by GPU index.
+			if slices.Equal(current, gpus) {
+				continue
+			}
+
+			added, removed := diffGpus(gpus, current)
+			app.logger.Info("gpu set changed", "added", len(added), "removed", len(removed), "gpus", len(current))
+
+			stop()
+			app.removeGpus(removed)
+			app.publishDiscovery(added)
+			// The consumer only publishes the availability on health changes,
+			// which a GPU removed and added again while healthy does not show.
+			for _, gpu := range added {
+				app.publishAvailability(gpu, true)
+			}
+			gpus = current
+			stop = app.startMonitor(ctx, gpus, out)
+		}
+	}
+}
+
+// startMonitor starts a combined monitor for gpus that forwards to out.
+// The returned function stops it and waits until forwarding finished.
+func (app *application) startMonitor(ctx context.Context, gpus []gpuinfo.GPU, out chan<- gpuinfo.GpuState) func() {
+	if len(gpus) == 0 {
+		app.logger.Warn("no nvidia gpus to monitor")
+		return func() {}
+	}
+
+	monitorCtx, cancel := context.WithCancel(ctx)
+	stateChan, err := app.collector.CombinedMonitor(monitorCtx, gpus)
+	if err != nil {
+		app.logger.Error("failed to start combined monitor", "error", err)
+		cancel()
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for state := range stateChan {
+			select {
+			case out <- state:
+			case <-monitorCtx.Done():
+				app.logger.Debug("forwarder context cancelled")
+			}
+		}
+		app.logger.Debug("forwarder finished")
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// diffGpus returns the GPUs only present in current and only present in
+// previous, matched by UUID.
+func diffGpus(previous, current []gpuinfo.GPU) (added, removed []gpuinfo.GPU) {
+	for _, gpu := range current {
+		if !containsUuid(previous, gpu.Uuid) {
+			added = append(added, gpu)
+		}
+	}
+	for _, gpu := range previous {
+		if !containsUuid(current, gpu.Uuid) {
+			removed = append(removed, gpu)
+		}
+	}
+	return added, removed
+}
+
+func containsUuid(gpus []gpuinfo.GPU, uuid string) bool {
+	return slices.ContainsFunc(gpus, func(gpu gpuinfo.GPU) bool { return gpu.Uuid == uuid })
+}
+
+// publishDiscovery publishes the Home Assistant discovery configs of gpus.
+func (app *application) publishDiscovery(gpus []gpuinfo.GPU) {
+	if !app.config.HA || len(gpus) == 0 {
+		return
+	}
+
+	app.logger.Info("publishing home assistant auto-discovery configs", "gpus", len(gpus))
+	err := homeassistant.PublishConfigs(app.mqttClient, gpus, app.config.Topic, app.sensors(), app.config.ExpireAfter())
+	if err != nil {
+		app.logger.Warn("failed to publish HA discovery configs", "error", err)
+	}
+}
+
+// removeGpus deletes the discovery configs and retained topics of GPUs that are gone.
+func (app *application) removeGpus(gpus []gpuinfo.GPU) {
+	for _, gpu := range gpus {
+		for _, suffix := range []string{"state", "error", "availability"} {
+			topic := fmt.Sprintf("%s/%s/%s", app.config.Topic, gpu.Uuid, suffix)
+			if err := app.mqttClient.Publish("", topic, true); err != nil {
+				app.logger.Warn("failed to clear retained topic", "gpu_uuid", gpu.Uuid, "topic", topic, "error", err)
+			}
+		}
+	}
+
+	if !app.config.HA || len(gpus) == 0 {
+		return
+	}
+	if err := homeassistant.RemoveConfigs(app.mqttClient, gpus, app.sensors()); err != nil {
+		app.logger.Warn("failed to remove HA discovery configs", "error", err)
+	}
+}
+
+func (app *application) sensors() map[string]homeassistant.SensorDescription {
+	sensors := homeassistant.SensorDescriptions(app.config.DmonGroups, app.config.AllQueryFields())
+	if app.config.PowerLimits {
+		sensors[gpuinfo.PowerLimitPercentKey] = homeassistant.PowerLimitPercentSensorDescription
+	}
+	window := time.Duration(app.config.StatsWindow) * time.Second
+	stats := homeassistant.StatsSensorDescriptions(sensors, app.config.StatsSensors, window, app.config.StatsP95)
+	maps.Copy(sensors, stats)
+	if app.config.RuntimePM {
+		sensors["power_state"] = homeassistant.PowerStateSensorDescription
+	}
+	if app.config.MemoryHealthInterval > 0 {
+		maps.Copy(sensors, homeassistant.MemorySensorDescriptions)
+	}
+	if app.config.PcieLink {
+		sensors["pcie_link_degraded"] = homeassistant.PcieLinkDegradedSensorDescription
+	}
+	if app.config.XidWatcher {
+		sensors["xid_errors"] = homeassistant.XidSensorDescription
+	}
+	return sensors
+}
+
+// consumeStates publishes the states of all GPUs until states is closed.
+func (app *application) consumeStates(states <-chan gpuinfo.GpuState) {
+	app.logger.Info("starting main metrics consumer")
+	lastPublished := make(map[string]GpuPublishedState)
+	forcePublishInterval := time.Duration(app.config.ForcePublish) * time.Second
+
+	for state := range states {
+		uuid := state.Gpu.Uuid
+		lastState, found := lastPublished[uuid]
+		if !found || state.Health != lastState.State.Health {
+			app.healthChanged(state, lastState.State.Health)
+		}
+		if state.Memory != nil && (lastState.State.Memory == nil || state.Memory.State != lastState.State.Memory.State) {
+			app.memoryHealthChanged(state, lastState.State.Memory)
+		}
+		if state.PcieLinkDegraded != nil && (lastState.State.PcieLinkDegraded == nil || *state.PcieLinkDegraded != *lastState.State.PcieLinkDegraded) {
+			app.pcieLinkChanged(state, lastState.State.PcieLinkDegraded)
+		}
+		if state.Xid != nil && state.Xid.Last != nil && (lastState.State.Xid == nil || state.Xid.Last != lastState.State.Xid.Last) {
+			app.publishXid(state)
+		}
+		forced := forcePublishInterval > 0 && time.Since(lastState.Timestamp) > forcePublishInterval
+		if !found || forced || app.changed(lastState.State, state) {
+			if state.Error != nil && (!found || state.Error != lastState.State.Error) {
+				app.publishError(state)
+			}
+
+			now := time.Now()
+			seq := lastState.Seq + 1
+			payload, err := json.Marshal(statePayload{GpuState: state, PublishedAt: now, Seq: seq})
+			if err != nil {
+				app.logger.Error("failed to marshal metrics", "gpu_uuid", state.Gpu.Uuid, "error", err)
+				continue
+			}
+
+			topic := fmt.Sprintf("%s/%s/state", app.config.Topic, state.Gpu.Uuid)
+			if err := app.mqttClient.Publish(string(payload), topic, false); err != nil {
+				app.logger.Error("failed to publish metrics", "gpu_uuid", state.Gpu.Uuid, "error", err)
+			}
+
+			lastPublished[uuid] = GpuPublishedState{
+				State:     state,
+				Timestamp: now,
+				Seq:       seq,
+			}
+		}
+	}
+	app.logger.Info("main metrics consumer stopped")
+}
+
+// changed reports whether state differs from the last published state. Metrics
+// with a deadband only count as changed once they moved past it. The
+// aggregates are derived from the metrics and do not count on their own.
+func (app *application) changed(previous, state gpuinfo.GpuState) bool {
+	// Sample times move with every sample and do not count as a change.
+	state.DmonSampledAt, state.QuerySampledAt = previous.DmonSampledAt, previous.QuerySampledAt
+	state.DmonMetrics.SampledAt = previous.DmonMetrics.SampledAt
+	if len(app.config.Deadbands) == 0 {
+		state.Stats, previous.Stats = nil, nil
+		return !reflect.DeepEqual(previous, state)
+	}
+
+	previousMetrics := previous.Metrics()
+	for name, value := range state.Metrics() {
+		deadband, found := app.config.Deadbands[name]
+		if !found {
+			if value != previousMetrics[name] {
+				return true
+			}
+			continue
+		}
+		if deadband.Exceeded(previousMetrics[name], value) {
+			return true
+		}
+	}
+
+	// Compare everything else with the metrics taken from the published state.
+	rest := state.WithMetrics(previousMetrics)
+	rest.Stats, previous.Stats = nil, nil
+	return !reflect.DeepEqual(previous, rest)
+}
+
+// publishError publishes the last collector error of a GPU as retained
+// message, so it stays visible while no fresh metrics arrive.
+func (app *application) publishError(state gpuinfo.GpuState) {
+	payload, err := json.Marshal(state.Error)
+	if err != nil {
+		app.logger.Error("failed to marshal error", "gpu_uuid", state.Gpu.Uuid, "error", err)
+		return
+	}
+
+	topic := fmt.Sprintf("%s/%s/error", app.config.Topic, state.Gpu.Uuid)
+	if err := app.mqttClient.Publish(string(payload), topic, true); err != nil {
+		app.logger.Error("failed to publish error", "gpu_uuid", state.Gpu.Uuid, "error", err)
+	}
+}
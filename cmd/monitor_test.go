@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/rbnhln/smi2mqtt/internal/config"
+	"github.com/rbnhln/smi2mqtt/internal/gpuinfo"
+)
+
+type message struct {
+	payload  string
+	topic    string
+	retained bool
+}
+
+// recordingClient is an mqtt.Client that records the published messages.
+type recordingClient struct {
+	mu       sync.Mutex
+	messages []message
+}
+
+func (c *recordingClient) Connect() error { return nil }
+
+func (c *recordingClient) Disconnect() {}
+
+func (c *recordingClient) Publish(payload string, topic string, retained bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, message{payload, topic, retained})
+	return nil
+}
+
+// published returns the messages of topic.
+func (c *recordingClient) published(topic string) []message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var messages []message
+	for _, m := range c.messages {
+		if m.topic == topic {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+func TestConsumeStates(t *testing.T) {
+	client := &recordingClient{}
+	app := &application{
+		config:     config.Config{Topic: "smi2mqtt"},
+		logger:     slog.New(slog.DiscardHandler),
+		mqttClient: client,
+	}
+	gpu := gpuinfo.GPU{Index: 0, Name: "NVIDIA GeForce RTX 4090", Uuid: "GPU-11111111-2222-3333-4444-555555555555"}
+	healthy := gpuinfo.GpuState{Gpu: gpu, Health: gpuinfo.HealthOK, DmonMetrics: gpuinfo.DmonMetrics{Pwr: gpuinfo.NewValue(72)}}
+	lost := healthy
+	lost.Health = gpuinfo.HealthGpuLost
+	lost.Error = &gpuinfo.GpuError{Message: "exit status 15: GPU is lost", Count: 1}
+
+	states := make(chan gpuinfo.GpuState)
+	go func() {
+		defer close(states)
+		// The unchanged second state is not published.
+		for _, state := range []gpuinfo.GpuState{healthy, healthy, lost} {
+			states <- state
+		}
+	}()
+	app.consumeStates(states)
+
+	published := client.published("smi2mqtt/" + gpu.Uuid + "/state")
+	if len(published) != 2 {
+		t.Fatalf("published %d states, want 2", len(published))
+	}
+	var payload struct {
+		Health gpuinfo.Health `json:"health"`
+		Seq    uint64         `json:"seq"`
+	}
+	if err := json.Unmarshal([]byte(published[1].payload), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Seq != 2 || payload.Health != gpuinfo.HealthGpuLost {
+		t.Errorf("last state has seq %d and health %q, want 2 and gpu_lost", payload.Seq, payload.Health)
+	}
+
+	availability := client.published("smi2mqtt/" + gpu.Uuid + "/availability")
+	if len(availability) != 2 || availability[0].payload != "online" || availability[1].payload != "offline" {
+		t.Errorf("availability = %+v, want online then offline", availability)
+	}
+
+	events := client.published("smi2mqtt/events")
+	if len(events) != 1 {
+		t.Fatalf("published %d events, want 1", len(events))
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(events[0].payload), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != "health" || event.Severity != severityCritical {
+		t.Errorf("event = %+v, want a critical health event", event)
+	}
+}
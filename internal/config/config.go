@@ -4,21 +4,105 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"math"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/rbnhln/smi2mqtt/internal/gpuinfo"
 )
 
+// Startup modes for when no GPUs are found.
+const (
+	StartupModeExit = "exit"
+	StartupModeWait = "wait"
+)
+
+// Deadband is the minimum change of a metric that triggers a publish.
+// A change has to exceed every threshold that is set.
+type Deadband struct {
+	// Abs is the absolute change in the unit of the metric.
+	Abs float64 `json:"abs,omitempty"`
+	// Rel is the change relative to the last published value, e.g. 0.05 for 5%.
+	Rel float64 `json:"rel,omitempty"`
+}
+
+// Exceeded reports whether the change from previous to current passes the deadband.
+// Changes between a missing and a real reading always pass.
+func (d Deadband) Exceeded(previous, current gpuinfo.Value) bool {
+	if previous.Status != current.Status || previous.Text != current.Text || previous.Bool != current.Bool {
+		return true
+	}
+	if !current.Valid() || current.Text != "" {
+		return false
+	}
+
+	diff := math.Abs(current.Num - previous.Num)
+	if diff == 0 {
+		return false
+	}
+	if d.Abs > 0 && diff <= d.Abs {
+		return false
+	}
+	if d.Rel > 0 && previous.Num != 0 && diff/math.Abs(previous.Num) <= d.Rel {
+		return false
+	}
+	return true
+}
+
 type Config struct {
-	Broker         string `json:"broker"`
-	ClientID       string `json:"client_id"`
-	Topic          string `json:"topic"`
-	MqttUsername   string `json:"mqtt_username"`
-	MqttPassword   string `json:"mqtt_password"`
-	HA             bool   `json:"ha"`
-	UpdateInterval int    `json:"update_interval"`
-	DmonInterval   int    `json:"dmon_interval"`
-	QueryInterval  int    `json:"query_interval"`
+	Broker               string  `json:"broker"`
+	ClientID             string  `json:"client_id"`
+	Topic                string  `json:"topic"`
+	MqttUsername         string  `json:"mqtt_username"`
+	MqttPassword         string  `json:"mqtt_password"`
+	HA                   bool    `json:"ha"`
+	UpdateInterval       int     `json:"update_interval"`
+	DmonInterval         int     `json:"dmon_interval"`
+	QueryInterval        int     `json:"query_interval"`
+	NvidiaSmiPath        string  `json:"nvidia_smi_path"`
+	DmonStallFactor      int     `json:"dmon_stall_factor"`
+	QueryMode            string  `json:"query_mode"`
+	QueryIntervalMs      int     `json:"query_interval_ms"`
+	DmonGroups           string  `json:"dmon_groups"`
+	SnapshotInterval     int     `json:"snapshot_interval"`
+	MemoryHealthInterval int     `json:"memory_health_interval"`
+	RescanInterval       int     `json:"rescan_interval"`
+	StartupMode          string  `json:"startup_mode"`
+	CommandTimeout       int     `json:"command_timeout"`
+	PublishInterval      int     `json:"publish_interval"`
+	PublishReduction     string  `json:"publish_reduction"`
+	StatsWindow          int     `json:"stats_window"`
+	StatsP95             bool    `json:"stats_p95"`
+	ForcePublish         int     `json:"force_publish_interval"`
+	DmonTimestamps       bool    `json:"dmon_timestamps"`
+	AdaptivePolling      bool    `json:"adaptive_polling"`
+	IdleThreshold        float64 `json:"idle_threshold"`
+	IdleAfter            int     `json:"idle_after"`
+	IdleDmonInterval     int     `json:"idle_dmon_interval"`
+	IdleQueryInterval    int     `json:"idle_query_interval"`
+	RuntimePM            bool    `json:"runtime_pm"`
+	ClockEvents          bool    `json:"clock_events"`
+	ClockEventCounter    bool    `json:"clock_event_counters"`
+	SysfsRoot            string  `json:"sysfs_root"`
+	XidWatcher           bool    `json:"xid_watcher"`
+	PcieLink             bool    `json:"pcie_link"`
+	PowerLimits          bool    `json:"power_limits"`
+	PcieDegradedLoad     float64 `json:"pcie_degraded_load"`
+	PcieDegradedAfter    int     `json:"pcie_degraded_after"`
+	XidLog               string  `json:"xid_log"`
+	// QueryFields are queried in addition to gpuinfo.DefaultQueryFields.
+	QueryFields []gpuinfo.QueryField `json:"query_fields,omitempty"`
+	// MetricGroups poll the listed query fields at their own interval.
+	MetricGroups []gpuinfo.QueryGroup `json:"metric_groups"`
+	// StatsSensors are the metrics, e.g. "dmon.pwr", that get Home Assistant
+	// sensors for their window aggregates.
+	StatsSensors []string `json:"stats_sensors,omitempty"`
+	// Deadbands are keyed by metric, e.g. "dmon.mclk". Metrics without a
+	// deadband are published on every change.
+	Deadbands map[string]Deadband `json:"deadbands,omitempty"`
 }
 
 // Load config
@@ -31,6 +115,22 @@ func Load(path string) (*Config, error) {
 	cfg.UpdateInterval = 0
 	cfg.DmonInterval = 0
 	cfg.QueryInterval = 0
+	cfg.NvidiaSmiPath = "nvidia-smi"
+	cfg.DmonStallFactor = 5
+	cfg.QueryMode = gpuinfo.QueryModePerGpu
+	cfg.DmonGroups = gpuinfo.DefaultDmonGroups
+	cfg.StartupMode = StartupModeExit
+	cfg.CommandTimeout = 10
+	cfg.PublishReduction = gpuinfo.ReductionLast
+	cfg.ForcePublish = 30
+	cfg.IdleThreshold = 5
+	cfg.IdleAfter = 60
+	cfg.IdleDmonInterval = 10
+	cfg.IdleQueryInterval = 60
+	cfg.SysfsRoot = "/sys"
+	cfg.XidLog = "/dev/kmsg"
+	cfg.PcieDegradedLoad = 50
+	cfg.PcieDegradedAfter = 60
 
 	// Load values from config file, if present
 	file, err := os.ReadFile(path)
@@ -41,6 +141,12 @@ func Load(path string) (*Config, error) {
 	} else if !os.IsNotExist(err) {
 		return nil, fmt.Errorf("failed to read config file %q: %w", path, err)
 	}
+	// The default groups are set after decoding, the decoder would write the
+	// configured groups into the elements of the shared slice otherwise. An
+	// explicit [] decodes to an empty slice and disables them.
+	if cfg.MetricGroups == nil {
+		cfg.MetricGroups = slices.Clone(gpuinfo.DefaultQueryGroups)
+	}
 
 	// create cli flags, and overwrite if provided
 	flag.StringVar(&cfg.Broker, "broker", cfg.Broker, "Broker address (e.g., tcp://127.0.0.1:1883)")
@@ -51,6 +157,37 @@ func Load(path string) (*Config, error) {
 	flag.IntVar(&cfg.UpdateInterval, "interval", cfg.UpdateInterval, "Legacy update interval in seconds; 0 disables this flag (default: 0)")
 	flag.IntVar(&cfg.DmonInterval, "dmon-interval", cfg.DmonInterval, "dmon update interval in seconds (default: 1 or update interval)")
 	flag.IntVar(&cfg.QueryInterval, "query-interval", cfg.QueryInterval, "query update interval in seconds (default: 10 or update interval)")
+	flag.StringVar(&cfg.NvidiaSmiPath, "nvidia-smi", cfg.NvidiaSmiPath, "path of the nvidia-smi binary")
+	flag.IntVar(&cfg.QueryIntervalMs, "query-interval-ms", cfg.QueryIntervalMs, "query update interval in milliseconds; overrides query-interval if set")
+	flag.StringVar(&cfg.QueryMode, "query-mode", cfg.QueryMode, "query-gpu mode: per_gpu, batched or stream")
+	flag.IntVar(&cfg.SnapshotInterval, "snapshot-interval", cfg.SnapshotInterval, "nvidia-smi -q -x snapshot interval in seconds; 0 disables snapshots")
+	flag.IntVar(&cfg.MemoryHealthInterval, "memory-health-interval", cfg.MemoryHealthInterval, "interval in seconds for ecc counters, retired pages and remapped rows; 0 disables memory health")
+	flag.IntVar(&cfg.RescanInterval, "rescan-interval", cfg.RescanInterval, "interval in seconds to re-enumerate gpus; 0 disables hot-plug detection")
+	flag.StringVar(&cfg.StartupMode, "startup-mode", cfg.StartupMode, "behavior when no gpus are found on startup: exit or wait")
+	flag.IntVar(&cfg.CommandTimeout, "command-timeout", cfg.CommandTimeout, "timeout in seconds for a single nvidia-smi call")
+	flag.IntVar(&cfg.PublishInterval, "publish-interval", cfg.PublishInterval, "publish one coalesced state per gpu every n seconds; 0 publishes every update")
+	flag.StringVar(&cfg.PublishReduction, "publish-reduction", cfg.PublishReduction, "reduction of the samples within a publish interval: last, avg or max")
+	flag.IntVar(&cfg.StatsWindow, "stats-window", cfg.StatsWindow, "window in seconds for min/max/avg aggregates of each metric; 0 disables them")
+	flag.BoolVar(&cfg.StatsP95, "stats-p95", cfg.StatsP95, "add the 95th percentile to the aggregates")
+	flag.IntVar(&cfg.ForcePublish, "force-publish-interval", cfg.ForcePublish, "publish unchanged states after this many seconds; 0 disables it")
+	flag.BoolVar(&cfg.DmonTimestamps, "dmon-timestamps", cfg.DmonTimestamps, "take the dmon sample time from dmon -o DT")
+	flag.BoolVar(&cfg.AdaptivePolling, "adaptive-polling", cfg.AdaptivePolling, "poll at the idle intervals while all gpus are idle")
+	flag.Float64Var(&cfg.IdleThreshold, "idle-threshold", cfg.IdleThreshold, "utilization in percent below which a gpu counts as idle")
+	flag.IntVar(&cfg.IdleAfter, "idle-after", cfg.IdleAfter, "seconds all gpus have to stay idle before switching to the idle intervals")
+	flag.IntVar(&cfg.IdleDmonInterval, "idle-dmon-interval", cfg.IdleDmonInterval, "dmon interval in seconds while idle")
+	flag.IntVar(&cfg.IdleQueryInterval, "idle-query-interval", cfg.IdleQueryInterval, "query interval in seconds while idle")
+	flag.BoolVar(&cfg.RuntimePM, "runtime-pm", cfg.RuntimePM, "skip gpus suspended by pci runtime power management instead of waking them")
+	flag.StringVar(&cfg.SysfsRoot, "sysfs-root", cfg.SysfsRoot, "mount point of sysfs")
+	flag.BoolVar(&cfg.PcieLink, "pcie-link", cfg.PcieLink, "query the pcie link generation and width and detect degraded links")
+	flag.Float64Var(&cfg.PcieDegradedLoad, "pcie-degraded-load", cfg.PcieDegradedLoad, "gpu utilization in percent from which a reduced pcie link counts as degraded")
+	flag.IntVar(&cfg.PcieDegradedAfter, "pcie-degraded-after", cfg.PcieDegradedAfter, "seconds a pcie link has to stay reduced under load to count as degraded")
+	flag.BoolVar(&cfg.PowerLimits, "power-limits", cfg.PowerLimits, "query the power limits and the averaged and instant power draw (recent drivers only)")
+	flag.BoolVar(&cfg.XidWatcher, "xid-watcher", cfg.XidWatcher, "follow the kernel log for nvidia xid errors")
+	flag.StringVar(&cfg.XidLog, "xid-log", cfg.XidLog, "kernel log followed by the xid watcher, /dev/kmsg or a log file")
+	flag.BoolVar(&cfg.ClockEvents, "clock-events", cfg.ClockEvents, "query the clock event (throttle) reasons")
+	flag.BoolVar(&cfg.ClockEventCounter, "clock-event-counters", cfg.ClockEventCounter, "query the cumulative clock event reason counters (recent drivers only)")
+	flag.StringVar(&cfg.DmonGroups, "dmon-groups", cfg.DmonGroups, "dmon metric groups, any of pucvmet")
+	flag.IntVar(&cfg.DmonStallFactor, "dmon-stall-factor", cfg.DmonStallFactor, "restart dmon after this many intervals without output")
 
 	if cfg.DmonInterval == 0 {
 		if cfg.UpdateInterval > 0 {
@@ -102,5 +239,244 @@ func (c *Config) Validate() error {
 	if c.QueryInterval < 1 {
 		return fmt.Errorf("query interval must be at least 1 second")
 	}
+	if c.DmonStallFactor < 2 {
+		return fmt.Errorf("dmon stall factor must be at least 2")
+	}
+	if c.QueryIntervalMs != 0 && c.QueryIntervalMs < 100 {
+		return fmt.Errorf("query interval in milliseconds must be 0 or at least 100")
+	}
+	switch c.QueryMode {
+	case gpuinfo.QueryModePerGpu, gpuinfo.QueryModeBatched, gpuinfo.QueryModeStream:
+	default:
+		return fmt.Errorf("query mode must be per_gpu, batched or stream")
+	}
+	if c.SnapshotInterval < 0 {
+		return fmt.Errorf("snapshot interval must be greater or equal zero")
+	}
+	if c.MemoryHealthInterval < 0 {
+		return fmt.Errorf("memory health interval must be greater or equal zero")
+	}
+	if c.RescanInterval < 0 {
+		return fmt.Errorf("rescan interval must be greater or equal zero")
+	}
+	if c.StartupMode != StartupModeExit && c.StartupMode != StartupModeWait {
+		return fmt.Errorf("startup mode must be exit or wait")
+	}
+	if c.CommandTimeout < 1 {
+		return fmt.Errorf("command timeout must be at least 1 second")
+	}
+	if c.PublishInterval < 0 {
+		return fmt.Errorf("publish interval must be greater or equal zero")
+	}
+	switch c.PublishReduction {
+	case gpuinfo.ReductionLast, gpuinfo.ReductionAvg, gpuinfo.ReductionMax:
+	default:
+		return fmt.Errorf("publish reduction must be last, avg or max")
+	}
+	if c.ForcePublish < 0 {
+		return fmt.Errorf("force publish interval must be greater or equal zero")
+	}
+	if c.AdaptivePolling {
+		if c.IdleThreshold <= 0 || c.IdleThreshold > 100 {
+			return fmt.Errorf("idle threshold must be between 0 and 100 percent")
+		}
+		if c.IdleAfter < 0 {
+			return fmt.Errorf("idle after must be greater or equal zero")
+		}
+		if c.IdleDmonInterval < c.DmonInterval {
+			return fmt.Errorf("idle dmon interval must be at least the dmon interval")
+		}
+		if time.Duration(c.IdleQueryInterval)*time.Second < c.QueryPeriod() {
+			return fmt.Errorf("idle query interval must be at least the query interval")
+		}
+	}
+	if c.RuntimePM && c.QueryMode == gpuinfo.QueryModeStream {
+		return fmt.Errorf("runtime pm cannot be used with query mode stream")
+	}
+	if c.RuntimePM && c.SysfsRoot == "" {
+		return fmt.Errorf("sysfs root is required for runtime pm")
+	}
+	if c.PcieDegradedLoad < 0 || c.PcieDegradedLoad > 100 {
+		return fmt.Errorf("pcie degraded load must be between 0 and 100")
+	}
+	if c.PcieDegradedAfter < 0 {
+		return fmt.Errorf("pcie degraded after must be greater or equal zero")
+	}
+	if c.XidWatcher && c.XidLog == "" {
+		return fmt.Errorf("xid log is required for the xid watcher")
+	}
+	if c.StatsWindow < 0 {
+		return fmt.Errorf("stats window must be greater or equal zero")
+	}
+	if len(c.StatsSensors) > 0 && c.StatsWindow == 0 {
+		return fmt.Errorf("stats sensors require a stats window")
+	}
+	if err := gpuinfo.ValidateDmonGroups(c.DmonGroups); err != nil {
+		return err
+	}
+	keys := make(map[string]bool)
+	for _, column := range gpuinfo.DmonColumns(gpuinfo.DefaultDmonGroups) {
+		keys[column] = true
+	}
+	for _, field := range c.AllQueryFields() {
+		if err := field.Validate(); err != nil {
+			return err
+		}
+		if keys[field.PayloadKey()] {
+			return fmt.Errorf("query field key %q is used more than once", field.PayloadKey())
+		}
+		keys[field.PayloadKey()] = true
+	}
+	if err := c.validateMetricGroups(); err != nil {
+		return err
+	}
+	for _, metric := range c.StatsSensors {
+		if !c.hasMetric(metric) {
+			return fmt.Errorf("unknown stats sensor metric %q", metric)
+		}
+	}
+	for metric, deadband := range c.Deadbands {
+		if !c.hasMetric(metric) {
+			return fmt.Errorf("unknown deadband metric %q", metric)
+		}
+		if deadband.Abs < 0 || deadband.Rel < 0 {
+			return fmt.Errorf("deadband of %q must not be negative", metric)
+		}
+	}
+	if c.NvidiaSmiPath == "" {
+		return fmt.Errorf("nvidia-smi path is required")
+	}
 	return nil
 }
+
+// AllQueryFields returns the default query fields followed by the configured
+// ones and the enabled built-in field sets.
+func (c *Config) AllQueryFields() []gpuinfo.QueryField {
+	extra := slices.Clone(c.QueryFields)
+	for _, set := range c.builtinGroups() {
+		extra = append(extra, set.fields...)
+	}
+	return gpuinfo.MergeQueryFields(extra)
+}
+
+// AllMetricGroups returns the configured metric groups followed by one group
+// per enabled built-in field set that needs its own, so unsupported fields of
+// older drivers don't fail the other queries. Fields already part of a
+// configured group stay there.
+func (c *Config) AllMetricGroups() []gpuinfo.QueryGroup {
+	groups := slices.Clone(c.MetricGroups)
+	interval := max(1, int(c.QueryPeriod().Seconds()))
+	for _, set := range c.builtinGroups() {
+		if !set.ownGroup {
+			continue
+		}
+		group := gpuinfo.QueryGroup{Name: set.name, Interval: interval}
+		for _, property := range gpuinfo.Properties(set.fields) {
+			if !slices.ContainsFunc(c.MetricGroups, func(g gpuinfo.QueryGroup) bool { return slices.Contains(g.Properties, property) }) {
+				group.Properties = append(group.Properties, property)
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+type builtinGroup struct {
+	name   string
+	fields []gpuinfo.QueryField
+	// ownGroup polls the fields separately instead of in the default group.
+	ownGroup bool
+}
+
+// builtinGroups returns the enabled built-in field sets.
+func (c *Config) builtinGroups() []builtinGroup {
+	var groups []builtinGroup
+	if c.ClockEvents {
+		groups = append(groups, builtinGroup{"clock_events", gpuinfo.ClockEventFields, true})
+	}
+	if c.ClockEventCounter {
+		groups = append(groups, builtinGroup{"clock_event_counters", gpuinfo.ClockEventCounterFields, true})
+	}
+	// The link is judged together with the utilization of the same sample.
+	if c.PcieLink {
+		groups = append(groups, builtinGroup{"pcie_link", gpuinfo.PcieLinkFields, false})
+	}
+	if c.PowerLimits {
+		groups = append(groups, builtinGroup{"power", gpuinfo.PowerFields, true})
+	}
+	return groups
+}
+
+func (c *Config) validateMetricGroups() error {
+	names := make(map[string]bool)
+	grouped := make(map[string]string)
+	fields := c.AllQueryFields()
+	for _, group := range c.AllMetricGroups() {
+		if group.Name == "" || names[group.Name] {
+			return fmt.Errorf("metric group names must be unique and not empty")
+		}
+		names[group.Name] = true
+		if group.Interval < 1 {
+			return fmt.Errorf("metric group %q: interval must be at least 1 second", group.Name)
+		}
+		for _, property := range group.Properties {
+			if !slices.ContainsFunc(fields, func(field gpuinfo.QueryField) bool { return field.Property == property }) {
+				return fmt.Errorf("metric group %q: unknown query field %q", group.Name, property)
+			}
+			if other, found := grouped[property]; found {
+				return fmt.Errorf("query field %q is part of metric groups %q and %q", property, other, group.Name)
+			}
+			grouped[property] = group.Name
+		}
+	}
+	return nil
+}
+
+// hasMetric reports whether metric, e.g. "dmon.pwr" or "query.utilgpu", is collected.
+func (c *Config) hasMetric(metric string) bool {
+	source, key, _ := strings.Cut(metric, ".")
+	switch source {
+	case "dmon":
+		return slices.Contains(gpuinfo.DmonColumns(c.DmonGroups), key)
+	case "query":
+		if key == gpuinfo.PowerLimitPercentKey {
+			return c.PowerLimits
+		}
+		return slices.ContainsFunc(c.AllQueryFields(), func(field gpuinfo.QueryField) bool {
+			return field.PayloadKey() == key
+		})
+	}
+	return false
+}
+
+// QueryPeriod returns the query interval, preferring the millisecond setting.
+func (c *Config) QueryPeriod() time.Duration {
+	if c.QueryIntervalMs > 0 {
+		return time.Duration(c.QueryIntervalMs) * time.Millisecond
+	}
+	return time.Duration(c.QueryInterval) * time.Second
+}
+
+// ExpireAfter returns the seconds after which Home Assistant marks the state
+// sensors of a GPU unavailable without a new state, 0 if unchanged states are
+// never published again. It allows twice the longest gap between two states,
+// the force publish interval plus the slowest interval states arrive at.
+func (c *Config) ExpireAfter() int {
+	if c.ForcePublish == 0 {
+		return 0
+	}
+	arrival := max(c.PublishInterval, c.DmonInterval)
+	if c.AdaptivePolling {
+		arrival = max(arrival, c.IdleDmonInterval)
+	}
+	return max(60, 2*(c.ForcePublish+arrival))
+}
+
+// XidLogPath returns the kernel log followed for Xid errors, empty if the
+// Xid watcher is disabled.
+func (c *Config) XidLogPath() string {
+	if !c.XidWatcher {
+		return ""
+	}
+	return c.XidLog
+}
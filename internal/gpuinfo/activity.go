@@ -0,0 +1,103 @@
+package gpuinfo
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// activity switches the monitors of all GPUs between the fast and the idle
+// polling rates. It turns idle once the utilization of every GPU stayed below
+// threshold for idleAfter, and busy again with the first sample above it.
+// A nil activity is always busy.
+type activity struct {
+	logger     *slog.Logger
+	threshold  float64
+	idleAfter  time.Duration
+	mu         sync.Mutex
+	lastActive time.Time
+	idle       bool
+	changed    chan struct{}
+}
+
+func newActivity(logger *slog.Logger, threshold float64, idleAfter time.Duration) *activity {
+	return &activity{
+		logger:     logger,
+		threshold:  threshold,
+		idleAfter:  idleAfter,
+		lastActive: time.Now(),
+		changed:    make(chan struct{}),
+	}
+}
+
+// state returns whether the GPUs are idle and a channel that is closed on the next change.
+func (a *activity) state() (bool, <-chan struct{}) {
+	if a == nil {
+		return false, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.idle, a.changed
+}
+
+// observe records a utilization sample of any GPU.
+func (a *activity) observe(util Value) {
+	if a == nil || !util.Valid() {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if util.Num >= a.threshold {
+		a.lastActive = now
+	}
+	idle := now.Sub(a.lastActive) >= a.idleAfter
+	if idle == a.idle {
+		return
+	}
+
+	a.idle = idle
+	close(a.changed)
+	a.changed = make(chan struct{})
+	a.logger.Info("gpu activity changed, switching polling rate", "idle", idle)
+}
+
+// run calls fn with the current state and restarts it whenever the state
+// changes, until ctx is cancelled.
+func (a *activity) run(ctx context.Context, fn func(ctx context.Context, idle bool)) {
+	for {
+		idle, changed := a.state()
+		runCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-changed:
+				cancel()
+			case <-runCtx.Done():
+			}
+		}()
+
+		fn(runCtx, idle)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// dmonInterval returns the dmon interval in seconds for the activity state.
+func (n *NvidiaSmi) dmonInterval(idle bool) int {
+	if idle {
+		return n.opts.IdleDmonInterval
+	}
+	return n.opts.DmonInterval
+}
+
+// queryInterval returns the query-gpu interval for the activity state.
+func (n *NvidiaSmi) queryInterval(idle bool) time.Duration {
+	if idle {
+		return n.opts.IdleQueryInterval
+	}
+	return n.opts.QueryInterval
+}
@@ -0,0 +1,80 @@
+package gpuinfo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCommandTimeout = 10 * time.Second
+	breakerThreshold      = 3
+	minBreakerBackoff     = 10 * time.Second
+	maxBreakerBackoff     = 5 * time.Minute
+)
+
+// breaker is a circuit breaker for polled nvidia-smi calls. After
+// breakerThreshold consecutive failures it opens and skips calls for a
+// backoff that doubles with every further failure.
+type breaker struct {
+	failures  int
+	backoff   time.Duration
+	openUntil time.Time
+}
+
+// allow reports whether the next call may run.
+func (b *breaker) allow() bool {
+	return !time.Now().Before(b.openUntil)
+}
+
+// success closes the breaker again.
+func (b *breaker) success() {
+	*b = breaker{}
+}
+
+// failure records a failed call and returns the backoff if the breaker opened.
+func (b *breaker) failure() time.Duration {
+	b.failures++
+	if b.failures < breakerThreshold {
+		return 0
+	}
+
+	if b.backoff == 0 {
+		b.backoff = minBreakerBackoff
+	} else {
+		b.backoff = min(b.backoff*2, maxBreakerBackoff)
+	}
+	b.openUntil = time.Now().Add(b.backoff)
+	return b.backoff
+}
+
+// output runs a short-lived nvidia-smi call, killing it after the command timeout.
+func (n *NvidiaSmi) output(ctx context.Context, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.opts.CommandTimeout)
+	defer cancel()
+
+	output, err := n.runner.Command(ctx, n.opts.Path, args...).Output()
+	if err == nil {
+		return output, nil
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("nvidia-smi timed out after %s", n.opts.CommandTimeout)
+	}
+
+	// nvidia-smi explains most failures on stderr or stdout, keep that next to the exit code.
+	if exitCode(err) < 0 {
+		return nil, err
+	}
+	var stderr string
+	var execErr *exec.ExitError
+	if errors.As(err, &execErr) {
+		stderr = strings.TrimSpace(string(execErr.Stderr))
+	}
+	if msg := firstNonEmpty(stderr, strings.TrimSpace(string(output))); msg != "" {
+		return nil, fmt.Errorf("%w: %s", err, msg)
+	}
+	return nil, err
+}
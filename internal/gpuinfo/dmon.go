@@ -0,0 +1,196 @@
+package gpuinfo
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runDmon keeps one supervised nvidia-smi dmon process running for all gpus
+// until ctx is cancelled. Its lines are demultiplexed by the GPU index in the
+// Id column into the channel of the matching GPU. The process is restarted
+// with the matching interval whenever the activity changes.
+func (n *NvidiaSmi) runDmon(ctx context.Context, gpus []GPU, sup *supervisor, act *activity, outs map[int]chan DmonMetrics) {
+	act.run(ctx, func(ctx context.Context, idle bool) {
+		interval := n.dmonInterval(idle)
+		sup.setStallTimeout(n.dmonStallTimeout(interval))
+		sup.run(ctx, func(ctx context.Context, wd *watchdog) error {
+			return n.runDmonOnce(ctx, gpus, interval, wd, outs)
+		})
+	})
+	n.logger.Info("dmon supervisor finished, shutting down monitor")
+}
+
+// runDmonOnce runs a single dmon process and returns once it exits. Lost
+// GPUs are left out, as a single one makes dmon fail for all.
+func (n *NvidiaSmi) runDmonOnce(ctx context.Context, gpus []GPU, interval int, wd *watchdog, outs map[int]chan DmonMetrics) error {
+	active := n.activeGpus(gpus)
+	if len(active) == 0 {
+		n.logger.Warn("all gpus lost, dmon stays stopped")
+		wd.Busy(true)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	intervalStr := strconv.Itoa(interval)
+	args := []string{"dmon", "-d", intervalStr, "-s", n.opts.DmonGroups, "--format", "csv", "-i", gpuUuids(active)}
+	if n.opts.DmonTimestamps {
+		args = append(args, "-o", "DT")
+	}
+	parser := newDmonParser(n.logger)
+
+	return n.runStream(ctx, "dmon", wd, args, func(line string) error {
+		metrics, ok := parser.parseLine(line)
+		if !ok {
+			return nil
+		}
+		out, found := outs[metrics.Id]
+		if !found {
+			n.logger.Debug("dmon line for unknown gpu index", "id", metrics.Id)
+			return nil
+		}
+
+		select {
+		case out <- metrics:
+			return nil
+		case <-ctx.Done():
+			n.logger.Debug("dmon context cancelled during send")
+			return ctx.Err()
+		}
+	})
+}
+
+// dmonStallTimeout is how long dmon may stay silent before it counts as stalled.
+func (n *NvidiaSmi) dmonStallTimeout(interval int) time.Duration {
+	return time.Duration(n.opts.DmonStallFactor*interval) * time.Second
+}
+
+// gpuUuids joins the UUIDs of gpus into an nvidia-smi -i argument.
+func gpuUuids(gpus []GPU) string {
+	uuids := make([]string, 0, len(gpus))
+	for _, gpu := range gpus {
+		uuids = append(uuids, gpu.Uuid)
+	}
+	return strings.Join(uuids, ",")
+}
+
+// defaultDmonColumns is the column layout of "dmon -s pucvmet" and is used
+// until dmon printed its own header line.
+var defaultDmonColumns = []string{
+	"gpu", "pwr", "gtemp", "mtemp", "sm", "mem", "enc", "dec", "jpg", "ofa", "mclk",
+	"pclk", "pviol", "tviol", "fb", "bar1", "ccpm", "sbecc", "dbecc", "pci", "rxpci", "txpci",
+}
+
+// dmonFields maps dmon column names to the matching DmonMetrics field.
+var dmonFields = map[string]func(m *DmonMetrics) *Value{
+	"pwr":   func(m *DmonMetrics) *Value { return &m.Pwr },
+	"gtemp": func(m *DmonMetrics) *Value { return &m.Gtemp },
+	"mtemp": func(m *DmonMetrics) *Value { return &m.Mtemp },
+	"sm":    func(m *DmonMetrics) *Value { return &m.Sm },
+	"mem":   func(m *DmonMetrics) *Value { return &m.Mem },
+	"enc":   func(m *DmonMetrics) *Value { return &m.Enc },
+	"dec":   func(m *DmonMetrics) *Value { return &m.Dec },
+	"jpg":   func(m *DmonMetrics) *Value { return &m.Jpg },
+	"ofa":   func(m *DmonMetrics) *Value { return &m.Ofa },
+	"mclk":  func(m *DmonMetrics) *Value { return &m.Mclk },
+	"pclk":  func(m *DmonMetrics) *Value { return &m.Pclk },
+	"pviol": func(m *DmonMetrics) *Value { return &m.Pviol },
+	"tviol": func(m *DmonMetrics) *Value { return &m.Tviol },
+	"fb":    func(m *DmonMetrics) *Value { return &m.Fb },
+	"bar1":  func(m *DmonMetrics) *Value { return &m.Bar1 },
+	"ccpm":  func(m *DmonMetrics) *Value { return &m.Ccpm },
+	"sbecc": func(m *DmonMetrics) *Value { return &m.Sbecc },
+	"dbecc": func(m *DmonMetrics) *Value { return &m.Dbecc },
+	"pci":   func(m *DmonMetrics) *Value { return &m.Pci },
+	"rxpci": func(m *DmonMetrics) *Value { return &m.Rxpci },
+	"txpci": func(m *DmonMetrics) *Value { return &m.Txpci },
+}
+
+// dmonParser maps dmon output to DmonMetrics by the column names of the
+// header line, as the column set differs between driver versions.
+type dmonParser struct {
+	logger  *slog.Logger
+	columns []string
+	units   []string
+}
+
+func newDmonParser(logger *slog.Logger) *dmonParser {
+	return &dmonParser{logger: logger, columns: defaultDmonColumns}
+}
+
+// parseLine parses one line of dmon output. Header and units lines update
+// the column map and report false, as do lines not matching the columns.
+func (p *dmonParser) parseLine(line string) (DmonMetrics, bool) {
+	if strings.HasPrefix(line, "#") {
+		p.parseHeader(line)
+		return DmonMetrics{}, false
+	}
+
+	parts := strings.Split(line, ",")
+	if len(parts) != len(p.columns) {
+		return DmonMetrics{}, false
+	}
+
+	var metrics DmonMetrics
+	var date, clock string
+	for i, column := range p.columns {
+		switch column {
+		case "gpu":
+			id, err := strconv.Atoi(strings.TrimSpace(parts[i]))
+			if err != nil {
+				return DmonMetrics{}, false
+			}
+			metrics.Id = id
+			continue
+		case "date":
+			date = strings.TrimSpace(parts[i])
+			continue
+		case "time":
+			clock = strings.TrimSpace(parts[i])
+			continue
+		}
+
+		field, found := dmonFields[column]
+		if !found {
+			if metrics.Extra == nil {
+				metrics.Extra = make(map[string]string)
+			}
+			metrics.Extra[column] = strings.TrimSpace(parts[i])
+			continue
+		}
+		*field(&metrics) = parseValue(parts[i])
+	}
+
+	metrics.SampledAt = time.Now()
+	if date != "" && clock != "" {
+		// "-o DT" prints the local time with second resolution.
+		if at, err := time.ParseInLocation("20060102 15:04:05", date+" "+clock, time.Local); err == nil {
+			metrics.SampledAt = at
+		}
+	}
+	return metrics, true
+}
+
+// parseHeader handles the "#gpu, pwr, ..." header and the "#Idx, W, ..." units line.
+func (p *dmonParser) parseHeader(line string) {
+	parts := strings.Split(strings.TrimPrefix(line, "#"), ",")
+	names := make([]string, 0, len(parts))
+	for _, part := range parts {
+		names = append(names, strings.ToLower(strings.TrimSpace(part)))
+	}
+
+	if slices.Contains(names, "gpu") {
+		p.columns = names
+		p.units = nil
+		return
+	}
+	if len(names) == len(p.columns) {
+		p.units = make([]string, 0, len(parts))
+		for _, part := range parts {
+			p.units = append(p.units, strings.TrimSpace(part))
+		}
+		p.logger.Debug("dmon column map", "columns", p.columns, "units", p.units)
+	}
+}
@@ -0,0 +1,78 @@
+package gpuinfo
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDmonParser(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []DmonMetrics
+		// sampledAt is the expected sample time, zero if taken on reading.
+		sampledAt time.Time
+	}{
+		{
+			name:   "header and units",
+			output: fixture(t, "dmon.csv"),
+			want: []DmonMetrics{
+				{Id: 0, Pwr: NewValue(72), Gtemp: NewValue(48), Sm: NewValue(35), Mclk: NewValue(9501), Fb: NewValue(1024)},
+				{Id: 1, Pwr: NewValue(18), Gtemp: NewValue(31), Sm: NewValue(0), Mclk: NewValue(405), Fb: NewValue(3)},
+			},
+		},
+		{
+			name:   "date and time of -o DT",
+			output: fixture(t, "dmon-dt.csv"),
+			want: []DmonMetrics{
+				{Id: 0, Pwr: NewValue(72), Gtemp: NewValue(48), Sm: NewValue(35), Mclk: NewValue(9501), Fb: NewValue(1024)},
+				{Id: 1, Pwr: NewValue(18), Gtemp: NewValue(31), Sm: NewValue(0), Mclk: NewValue(405), Fb: NewValue(3)},
+			},
+			sampledAt: time.Date(2026, 10, 16, 9, 31, 12, 0, time.Local),
+		},
+		{
+			name:   "default columns before the header",
+			output: "    0,     72,     48,      -,     35,     12,      0,      0,      0,      0,   9501,   2520,      0,      0,   1024,      5,      0,      -,      -,      0,     12,      3\n",
+			want: []DmonMetrics{
+				{Id: 0, Pwr: NewValue(72), Gtemp: NewValue(48), Sm: NewValue(35), Mclk: NewValue(9501), Fb: NewValue(1024)},
+			},
+		},
+		{
+			name:   "unknown columns and short lines",
+			output: "#gpu, pwr, gtemp, nvlrx\n#Idx, W, C, MB/s\n0, 120, 61, 4096\n0, 120\n",
+			want: []DmonMetrics{
+				{Id: 0, Pwr: NewValue(120), Gtemp: NewValue(61), Extra: map[string]string{"nvlrx": "4096"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := newDmonParser(slog.New(slog.DiscardHandler))
+			var got []DmonMetrics
+			for line := range strings.Lines(tt.output) {
+				if metrics, ok := parser.parseLine(strings.TrimRight(line, "\n")); ok {
+					got = append(got, metrics)
+				}
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("parsed %d lines, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				metrics := got[i]
+				if metrics.Id != want.Id || metrics.Pwr != want.Pwr || metrics.Gtemp != want.Gtemp || metrics.Mtemp != want.Mtemp ||
+					metrics.Sm != want.Sm || metrics.Mclk != want.Mclk || metrics.Fb != want.Fb {
+					t.Errorf("line %d = %+v, want %+v", i, metrics, want)
+				}
+				if want.Extra != nil && metrics.Extra["nvlrx"] != want.Extra["nvlrx"] {
+					t.Errorf("line %d: extra = %v, want %v", i, metrics.Extra, want.Extra)
+				}
+				if !tt.sampledAt.IsZero() && !metrics.SampledAt.Equal(tt.sampledAt) {
+					t.Errorf("line %d: sampled at %v, want %v", i, metrics.SampledAt, tt.sampledAt)
+				}
+			}
+		})
+	}
+}
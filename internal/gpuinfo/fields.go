@@ -0,0 +1,212 @@
+package gpuinfo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Types of query-gpu fields.
+const (
+	FieldInt    = "int"
+	FieldFloat  = "float"
+	FieldString = "string"
+	FieldBool   = "bool"
+)
+
+// QueryField declares a --query-gpu property, its type and how it is published.
+type QueryField struct {
+	// Property is the query-gpu property, e.g. "power.draw.average".
+	Property string `json:"property"`
+	// Key is the key in the state payload, derived from Property if empty.
+	Key         string `json:"key,omitempty"`
+	Type        string `json:"type"`
+	Unit        string `json:"unit,omitempty"`
+	Name        string `json:"name,omitempty"`
+	DeviceClass string `json:"device_class,omitempty"`
+	StateClass  string `json:"state_class,omitempty"`
+	// EntityCategory is the Home Assistant entity category, e.g. "diagnostic".
+	EntityCategory string `json:"entity_category,omitempty"`
+}
+
+// PayloadKey returns the key of the field in the "query" object of the state payload.
+func (f QueryField) PayloadKey() string {
+	if f.Key != "" {
+		return f.Key
+	}
+	return strings.ReplaceAll(f.Property, ".", "_")
+}
+
+// DisplayName returns the human readable name of the field.
+func (f QueryField) DisplayName() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return f.Property
+}
+
+func (f QueryField) Validate() error {
+	if f.Property == "" || strings.ContainsAny(f.Property, ", ") {
+		return fmt.Errorf("invalid query field property %q", f.Property)
+	}
+	switch f.Type {
+	case FieldInt, FieldFloat, FieldString, FieldBool:
+	default:
+		return fmt.Errorf("query field %q: type must be int, float, string or bool", f.Property)
+	}
+	switch f.EntityCategory {
+	case "", "config", "diagnostic":
+	default:
+		return fmt.Errorf("query field %q: entity category must be config or diagnostic", f.Property)
+	}
+	return nil
+}
+
+// parse converts a raw query-gpu value according to the field type.
+func (f QueryField) parse(raw string) Value {
+	switch f.Type {
+	case FieldString:
+		return parseText(raw)
+	case FieldBool:
+		return parseBool(raw)
+	}
+	return parseValue(raw)
+}
+
+// DefaultQueryFields are always queried and keep the payload keys of earlier releases.
+var DefaultQueryFields = []QueryField{
+	{Property: "utilization.gpu", Key: "utilgpu", Type: FieldInt, Unit: "%", Name: "GPU Utilization"},
+	{Property: "memory.used", Key: "memused", Type: FieldInt, Unit: "MiB", Name: "Memory Used", DeviceClass: "data_size"},
+	{Property: "memory.free", Key: "memfree", Type: FieldInt, Unit: "MiB", Name: "Memory Free", DeviceClass: "data_size"},
+	{Property: "driver_version", Key: "drivver", Type: FieldString, Name: "Driver Version"},
+	{Property: "fan.speed", Key: "fanspe", Type: FieldInt, Unit: "%", Name: "Fan Speed"},
+	{Property: "pstate", Key: "pstat", Type: FieldString, Name: "Power State"},
+}
+
+// ClockEventFields report why the clocks are reduced, available since driver 530.
+var ClockEventFields = []QueryField{
+	{Property: "clocks_event_reasons.gpu_idle", Type: FieldBool, Name: "Clocks Idle"},
+	{Property: "clocks_event_reasons.applications_clocks_setting", Type: FieldBool, Name: "Clocks Application Setting"},
+	{Property: "clocks_event_reasons.sw_power_cap", Type: FieldBool, Name: "SW Power Cap", DeviceClass: "problem"},
+	{Property: "clocks_event_reasons.hw_slowdown", Type: FieldBool, Name: "HW Slowdown", DeviceClass: "problem"},
+	{Property: "clocks_event_reasons.hw_thermal_slowdown", Type: FieldBool, Name: "HW Thermal Slowdown", DeviceClass: "problem"},
+	{Property: "clocks_event_reasons.hw_power_brake_slowdown", Type: FieldBool, Name: "HW Power Brake Slowdown", DeviceClass: "problem"},
+	{Property: "clocks_event_reasons.sw_thermal_slowdown", Type: FieldBool, Name: "SW Thermal Slowdown", DeviceClass: "problem"},
+	{Property: "clocks_event_reasons.sync_boost", Type: FieldBool, Name: "Sync Boost", DeviceClass: "problem"},
+}
+
+// ClockEventCounterFields are the cumulative durations of the clock event
+// reasons in microseconds. Only recent drivers support them.
+var ClockEventCounterFields = []QueryField{
+	{Property: "clocks_event_reasons_counters.sw_power_cap", Type: FieldInt, Unit: "μs", Name: "SW Power Cap Time", DeviceClass: "duration", StateClass: "total_increasing"},
+	{Property: "clocks_event_reasons_counters.hw_thermal_slowdown", Type: FieldInt, Unit: "μs", Name: "HW Thermal Slowdown Time", DeviceClass: "duration", StateClass: "total_increasing"},
+	{Property: "clocks_event_reasons_counters.hw_power_brake_slowdown", Type: FieldInt, Unit: "μs", Name: "HW Power Brake Slowdown Time", DeviceClass: "duration", StateClass: "total_increasing"},
+	{Property: "clocks_event_reasons_counters.sw_thermal_slowdown", Type: FieldInt, Unit: "μs", Name: "SW Thermal Slowdown Time", DeviceClass: "duration", StateClass: "total_increasing"},
+	{Property: "clocks_event_reasons_counters.sync_boost", Type: FieldInt, Unit: "μs", Name: "Sync Boost Time", DeviceClass: "duration", StateClass: "total_increasing"},
+}
+
+// PcieLinkFields are the current and maximum PCIe link generation and width.
+// The current values drop while the GPU is idle to save power.
+var PcieLinkFields = []QueryField{
+	{Property: "pcie.link.gen.current", Type: FieldInt, Name: "PCIe Link Gen"},
+	{Property: "pcie.link.gen.max", Type: FieldInt, Name: "PCIe Link Gen Max"},
+	{Property: "pcie.link.width.current", Type: FieldInt, Name: "PCIe Link Width"},
+	{Property: "pcie.link.width.max", Type: FieldInt, Name: "PCIe Link Width Max"},
+}
+
+// PowerFields are the power limits and the averaged and instant power draw.
+// The draw fields need a recent driver. The limits are settings rather than
+// readings and are published as diagnostic entities.
+var PowerFields = []QueryField{
+	{Property: "power.draw.average", Type: FieldFloat, Unit: "W", Name: "Power Draw Average", DeviceClass: "power"},
+	{Property: "power.draw.instant", Type: FieldFloat, Unit: "W", Name: "Power Draw Instant", DeviceClass: "power"},
+	{Property: "power.limit", Type: FieldFloat, Unit: "W", Name: "Power Limit", DeviceClass: "power", EntityCategory: "diagnostic"},
+	{Property: "enforced.power.limit", Type: FieldFloat, Unit: "W", Name: "Enforced Power Limit", DeviceClass: "power", EntityCategory: "diagnostic"},
+	{Property: "power.default_limit", Type: FieldFloat, Unit: "W", Name: "Default Power Limit", DeviceClass: "power", EntityCategory: "diagnostic"},
+	{Property: "power.min_limit", Type: FieldFloat, Unit: "W", Name: "Min Power Limit", DeviceClass: "power", EntityCategory: "diagnostic"},
+	{Property: "power.max_limit", Type: FieldFloat, Unit: "W", Name: "Max Power Limit", DeviceClass: "power", EntityCategory: "diagnostic"},
+}
+
+// Properties returns the query-gpu properties of fields.
+func Properties(fields []QueryField) []string {
+	properties := make([]string, 0, len(fields))
+	for _, field := range fields {
+		properties = append(properties, field.Property)
+	}
+	return properties
+}
+
+// MergeQueryFields returns the default fields followed by extra,
+// skipping properties that are already part of the list.
+func MergeQueryFields(extra []QueryField) []QueryField {
+	fields := append([]QueryField(nil), DefaultQueryFields...)
+	for _, field := range extra {
+		if !containsProperty(fields, field.Property) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func containsProperty(fields []QueryField, property string) bool {
+	for _, field := range fields {
+		if field.Property == property {
+			return true
+		}
+	}
+	return false
+}
+
+// queryProperties joins the properties of fields into a --query-gpu argument.
+func queryProperties(fields []QueryField) string {
+	return strings.Join(Properties(fields), ",")
+}
+
+// QueryGroup is a named set of query fields polled at its own interval.
+type QueryGroup struct {
+	Name string `json:"name"`
+	// Interval between two polls in seconds.
+	Interval int `json:"interval"`
+	// Properties are the query-gpu properties of the group, e.g. "driver_version".
+	Properties []string `json:"fields"`
+}
+
+// DefaultQueryGroups poll static fields hourly instead of every query interval.
+var DefaultQueryGroups = []QueryGroup{
+	{Name: "static", Interval: 3600, Properties: []string{"driver_version"}},
+}
+
+// DefaultDmonGroups are the dmon metric groups selected with "dmon -s".
+const DefaultDmonGroups = "pucvmet"
+
+// DmonGroupColumns lists the dmon columns reported by each metric group.
+var DmonGroupColumns = map[rune][]string{
+	'p': {"pwr", "gtemp", "mtemp"},
+	'u': {"sm", "mem", "enc", "dec", "jpg", "ofa"},
+	'c': {"mclk", "pclk"},
+	'v': {"pviol", "tviol"},
+	'm': {"fb", "bar1", "ccpm"},
+	'e': {"sbecc", "dbecc", "pci"},
+	't': {"rxpci", "txpci"},
+}
+
+// DmonColumns returns the dmon columns reported for groups.
+func DmonColumns(groups string) []string {
+	var columns []string
+	for _, group := range groups {
+		columns = append(columns, DmonGroupColumns[group]...)
+	}
+	return columns
+}
+
+// ValidateDmonGroups checks that groups only selects known dmon metric groups.
+func ValidateDmonGroups(groups string) error {
+	if groups == "" {
+		return fmt.Errorf("at least one dmon group is required")
+	}
+	for _, group := range groups {
+		if _, found := DmonGroupColumns[group]; !found {
+			return fmt.Errorf("unknown dmon group %q", group)
+		}
+	}
+	return nil
+}
@@ -5,10 +5,11 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"os/exec"
+	"maps"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,56 +22,222 @@ import (
 // --query-compute-apps=name,used_memory
 
 type DmonMetrics struct {
-	Id    int `json:"id"`
-	Pwr   int `json:"pwr"`
-	Gtemp int `json:"gtemp"`
-	Mtemp int `json:"mtemp"`
-	Sm    int `json:"sm"`
-	Mem   int `json:"mem"`
-	Enc   int `json:"enc"`
-	Dec   int `json:"dec"`
-	Jpg   int `json:"jpg"`
-	Ofa   int `json:"ofa"`
-	Mclk  int `json:"mclk"`
-	Pclk  int `json:"pclk"`
-	Pviol int `json:"pviol"`
-	Tviol int `json:"tviol"`
-	Fb    int `json:"fb"`
-	Bar1  int `json:"bar1"`
-	Ccpm  int `json:"ccpm"`
-	Sbecc int `json:"sbecc"`
-	Dbecc int `json:"dbecc"`
-	Pci   int `json:"pci"`
-	Rxpci int `json:"rxpci"`
-	Txpci int `json:"txpci"`
-	Gpu   GPU `json:"gpu"`
+	Id    int   `json:"id"`
+	Pwr   Value `json:"pwr"`
+	Gtemp Value `json:"gtemp"`
+	Mtemp Value `json:"mtemp"`
+	Sm    Value `json:"sm"`
+	Mem   Value `json:"mem"`
+	Enc   Value `json:"enc"`
+	Dec   Value `json:"dec"`
+	Jpg   Value `json:"jpg"`
+	Ofa   Value `json:"ofa"`
+	Mclk  Value `json:"mclk"`
+	Pclk  Value `json:"pclk"`
+	Pviol Value `json:"pviol"`
+	Tviol Value `json:"tviol"`
+	Fb    Value `json:"fb"`
+	Bar1  Value `json:"bar1"`
+	Ccpm  Value `json:"ccpm"`
+	Sbecc Value `json:"sbecc"`
+	Dbecc Value `json:"dbecc"`
+	Pci   Value `json:"pci"`
+	Rxpci Value `json:"rxpci"`
+	Txpci Value `json:"txpci"`
+	Gpu   GPU   `json:"gpu"`
+	// Extra holds the raw values of dmon columns without a dedicated field.
+	Extra map[string]string `json:"extra,omitempty"`
+	// SampledAt is the time reported by "dmon -o DT" or the time the line was read.
+	SampledAt time.Time `json:"-"`
 }
 
-type QueryMetrics struct {
-	UtilGpu int    `json:"utilgpu"`
-	MemUsed int    `json:"memused"`
-	MemFree int    `json:"memfree"`
-	DrivVer string `json:"drivver"`
-	FanSpe  int    `json:"fanspe"`
-	Pstat   string `json:"pstat"`
-}
+// QueryMetrics holds the query-gpu values keyed by QueryField.PayloadKey.
+type QueryMetrics map[string]Value
 
 type GpuState struct {
-	Gpu          GPU          `json:"gpu"`
-	DmonMetrics  DmonMetrics  `json:"dmon"`
-	QueryMetrics QueryMetrics `json:"query"`
+	Gpu            GPU          `json:"gpu"`
+	DmonMetrics    DmonMetrics  `json:"dmon"`
+	DmonSampledAt  time.Time    `json:"dmon_sampled_at,omitzero"`
+	QueryMetrics   QueryMetrics `json:"query"`
+	QuerySampledAt time.Time    `json:"query_sampled_at,omitzero"`
+	DmonRestarts   uint64       `json:"dmon_restarts"`
+	QueryRestarts  uint64       `json:"query_restarts"`
+	Snapshot       *Snapshot    `json:"snapshot,omitempty"`
+	// Memory is the ECC and memory repair view, if memory health is enabled.
+	Memory *MemoryHealth `json:"memory,omitempty"`
+	// PcieLinkDegraded tells whether the PCIe link stayed below its maximum
+	// generation or width under load. It is unset until the link was seen
+	// under load and if PCIe link monitoring is disabled.
+	PcieLinkDegraded *bool `json:"pcie_link_degraded,omitempty"`
+	// Xid counts the Xid errors in the kernel log, if the Xid watcher is enabled.
+	Xid *XidErrors `json:"xid,omitempty"`
+	// Stats are the aggregates of the metrics over the stats window, if enabled.
+	Stats Stats `json:"stats,omitempty"`
+	// Health turns fatal once a call fails with a known fatal condition and
+	// recovers with the next metrics received for the GPU.
+	Health Health `json:"health"`
+	// PowerState is the runtime PM state, see PowerStateActive and
+	// PowerStateSuspended. It is only set if runtime PM is enabled.
+	PowerState string `json:"power_state,omitempty"`
+	// Error is the last collector error of the GPU, it is published on its own topic.
+	Error *GpuError `json:"-"`
+}
+
+// GpuError describes the last failed nvidia-smi call affecting a GPU.
+type GpuError struct {
+	Message   string    `json:"message"`
+	Count     uint64    `json:"count"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 type GPU struct {
 	Index int    `json:"index"`
 	Name  string `json:"name"`
 	Uuid  string `json:"uuid"`
+	// PciBusId is the PCI address in sysfs form, e.g. "0000:01:00.0".
+	PciBusId string `json:"pci_bus_id"`
+}
+
+// Collector is a source of GPU inventory and metrics.
+type Collector interface {
+	// GetGpuInfo lists all GPUs available to the collector.
+	GetGpuInfo(ctx context.Context) ([]GPU, error)
+	// CombinedMonitor streams the merged metrics of gpus until ctx is cancelled.
+	CombinedMonitor(ctx context.Context, gpus []GPU) (<-chan GpuState, error)
+	// SuspendedGpus returns the gpus that a call to the collector would wake.
+	SuspendedGpus(gpus []GPU) []GPU
+}
+
+// Options configures the nvidia-smi collector.
+type Options struct {
+	// Path of the nvidia-smi binary.
+	Path string
+	// DmonInterval is the dmon sampling interval in seconds.
+	DmonInterval int
+	// DmonStallFactor is the number of intervals without output after
+	// which the dmon or streaming query process is restarted.
+	DmonStallFactor int
+	// QueryInterval is the time between two query-gpu calls.
+	QueryInterval time.Duration
+	// QueryFields are the query-gpu properties to read.
+	QueryFields []QueryField
+	// DmonGroups selects the dmon metric groups, see DmonGroupColumns.
+	DmonGroups string
+	// SnapshotInterval is the time between two "nvidia-smi -q -x" calls, 0 disables them.
+	SnapshotInterval time.Duration
+	// MemoryHealthInterval is the time between two reads of the ECC counters,
+	// retired pages and remapped rows, 0 disables them.
+	MemoryHealthInterval time.Duration
+	// PcieLink judges the PCIe link fields of the query, see PcieLinkFields.
+	// A link below its maximum while the utilization is at least
+	// PcieDegradedLoad percent for PcieDegradedAfter counts as degraded.
+	PcieLink          bool
+	PcieDegradedLoad  float64
+	PcieDegradedAfter time.Duration
+	// PowerLimitPercent derives PowerLimitPercentKey from the PowerFields of the query.
+	PowerLimitPercent bool
+	// XidLog is the kernel log followed for Xid errors, e.g. "/dev/kmsg".
+	// Empty disables the Xid watcher.
+	XidLog string
+	// QueryMode selects how query-gpu is run, see QueryModePerGpu,
+	// QueryModeBatched and QueryModeStream.
+	QueryMode string
+	// CommandTimeout is the deadline of a single short-lived nvidia-smi call.
+	CommandTimeout time.Duration
+	// PublishInterval coalesces the updates of a GPU into one state per
+	// interval, 0 emits a state on every update.
+	PublishInterval time.Duration
+	// Reduction selects how the samples of a publish interval are combined,
+	// see ReductionLast, ReductionAvg and ReductionMax.
+	Reduction string
+	// StatsWindow is the rolling window of the min/max/avg aggregates, 0 disables them.
+	StatsWindow time.Duration
+	// StatsPercentile adds the 95th percentile to the aggregates.
+	StatsPercentile bool
+	// DmonTimestamps runs dmon with "-o DT" to take the sample time from its output.
+	DmonTimestamps bool
+	// AdaptivePolling switches to IdleDmonInterval and IdleQueryInterval while
+	// the utilization of all GPUs stays below IdleThreshold for IdleAfter.
+	AdaptivePolling   bool
+	IdleThreshold     float64
+	IdleAfter         time.Duration
+	IdleDmonInterval  int
+	IdleQueryInterval time.Duration
+	// QueryGroups poll their query fields at their own interval instead of QueryInterval.
+	QueryGroups []QueryGroup
+	// RuntimePM skips GPUs whose PCI runtime status in sysfs is suspended
+	// instead of waking them, and samples dmon with short-lived calls.
+	RuntimePM bool
+	// SysfsRoot is the mount point of sysfs, "/sys" by default.
+	SysfsRoot string
+}
+
+// NvidiaSmi is the Collector backed by the nvidia-smi command line tool.
+type NvidiaSmi struct {
+	runner Runner
+	logger *slog.Logger
+	opts   Options
+
+	// lost holds the UUIDs of GPUs reported lost, which are left out of
+	// calls shared with other GPUs until the monitor is restarted.
+	lost sync.Map
+
+	// mu guards the state kept across monitor restarts, e.g. after a rescan.
+	mu       sync.Mutex
+	counters map[string]gpuCounters
+	xidPos   xidPosition
+}
+
+// gpuCounters are the counters of a GPU that survive a monitor restart.
+type gpuCounters struct {
+	xid   *XidErrors
+	error *GpuError
+}
+
+func (n *NvidiaSmi) loadCounters(uuid string) gpuCounters {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.counters[uuid]
+}
+
+func (n *NvidiaSmi) storeCounters(uuid string, counters gpuCounters) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.counters == nil {
+		n.counters = make(map[string]gpuCounters)
+	}
+	n.counters[uuid] = counters
+}
+
+func NewNvidiaSmi(runner Runner, logger *slog.Logger, opts Options) *NvidiaSmi {
+	if opts.Path == "" {
+		opts.Path = "nvidia-smi"
+	}
+	if len(opts.QueryFields) == 0 {
+		opts.QueryFields = DefaultQueryFields
+	}
+	if opts.DmonGroups == "" {
+		opts.DmonGroups = DefaultDmonGroups
+	}
+	if opts.CommandTimeout <= 0 {
+		opts.CommandTimeout = defaultCommandTimeout
+	}
+	if opts.SysfsRoot == "" {
+		opts.SysfsRoot = "/sys"
+	}
+	if opts.Reduction == "" {
+		opts.Reduction = ReductionLast
+	}
+	return &NvidiaSmi{
+		runner: runner,
+		logger: logger,
+		opts:   opts,
+	}
 }
 
 // GetGpuInfo extracts a list of all GPUs found by nvidia-smi.
-func GetGpuInfo() ([]GPU, error) {
-	cmd := exec.Command("nvidia-smi", "--query-gpu", "index,gpu_name,gpu_uuid", "--format", "csv,noheader,nounits")
-	output, err := cmd.Output()
+func (n *NvidiaSmi) GetGpuInfo(ctx context.Context) ([]GPU, error) {
+	output, err := n.output(ctx, "--query-gpu", "index,gpu_name,gpu_uuid,pci.bus_id", "--format", "csv,noheader,nounits")
 	if err != nil {
 		return nil, fmt.Errorf("failed to run nvidia-smi: %w", err)
 	}
@@ -82,7 +249,7 @@ func GetGpuInfo() ([]GPU, error) {
 		line := scanner.Text()
 		parts := strings.Split(line, ",")
 
-		if len(parts) != 3 {
+		if len(parts) != 4 {
 			continue
 		}
 
@@ -91,9 +258,10 @@ func GetGpuInfo() ([]GPU, error) {
 			continue
 		}
 		gpu := GPU{
-			Index: index,
-			Name:  strings.TrimSpace(parts[1]),
-			Uuid:  strings.TrimSpace(parts[2]),
+			Index:    index,
+			Name:     strings.TrimSpace(parts[1]),
+			Uuid:     strings.TrimSpace(parts[2]),
+			PciBusId: normalizeBusId(parts[3]),
 		}
 		gpus = append(gpus, gpu)
 	}
@@ -106,254 +274,493 @@ func GetGpuInfo() ([]GPU, error) {
 	return gpus, nil
 }
 
-func CombinedMonitor(ctx context.Context, logger *slog.Logger, gpu GPU, dmonIntervalSeconds int, queryInterval time.Duration) (<-chan GpuState, error) {
+// CombinedMonitor starts one shared dmon process for all gpus plus the query
+// workers selected by the query mode and merges their results into per-GPU states. The states of
+// all GPUs are delivered on the returned channel.
+func (n *NvidiaSmi) CombinedMonitor(ctx context.Context, gpus []GPU) (<-chan GpuState, error) {
+	if len(gpus) == 0 {
+		return nil, fmt.Errorf("no gpus to monitor")
+	}
+	for _, gpu := range gpus {
+		if !isValidGPUUUID(gpu.Uuid) {
+			return nil, fmt.Errorf("invalid GPU UUID format: %q", gpu.Uuid)
+		}
+		n.lost.Delete(gpu.Uuid)
+	}
+
 	// Outgoing channel exposed to callers.
 	combinedStateChan := make(chan GpuState)
 
-	// Internal channels for worker results.
-	dmonChan := make(chan DmonMetrics)
-	queryChan := make(chan QueryMetrics)
+	// Internal channels for worker results, keyed by GPU index as reported by dmon.
+	dmonChans := make(map[int]chan DmonMetrics, len(gpus))
+	for _, gpu := range gpus {
+		dmonChans[gpu.Index] = make(chan DmonMetrics)
+	}
+	// Error channels are never closed, as several workers report to them.
+	errChans := make(map[string]chan error, len(gpus))
+	for _, gpu := range gpus {
+		errChans[gpu.Uuid] = make(chan error)
+	}
+	report := func(err error, targets ...GPU) {
+		n.reportError(ctx, gpus, errChans, err, targets...)
+	}
+	restarted := func(err error) { report(err) }
 
-	// Goroutine for dmon
-	go func() {
-		defer close(dmonChan)
-		runDmon(ctx, logger, gpu, dmonIntervalSeconds, dmonChan)
-	}()
+	var act *activity
+	if n.opts.AdaptivePolling {
+		act = newActivity(n.logger, n.opts.IdleThreshold, n.opts.IdleAfter)
+	}
 
-	// Goroutine for query
-	go func() {
-		defer close(queryChan)
-		runQuery(ctx, logger, gpu, queryInterval, queryChan)
-	}()
+	dmonSup := newSupervisor("dmon", n.logger, n.dmonStallTimeout(n.opts.DmonInterval))
+	dmonSup.onRestart = restarted
 
-	// Merge worker updates into a single state stream.
+	// Goroutine for the shared dmon process
 	go func() {
-		defer close(combinedStateChan)
-
-		var currentState GpuState
-		currentState.Gpu = gpu
-		channelsOpen := func() bool {
-			return dmonChan != nil || queryChan != nil
+		defer func() {
+			for _, ch := range dmonChans {
+				close(ch)
+			}
+		}()
+		if n.opts.RuntimePM {
+			n.runPolledDmon(ctx, gpus, act, dmonChans, report)
+			return
 		}
+		n.runDmon(ctx, gpus, dmonSup, act, dmonChans)
+	}()
+
+	queryChans := make(map[string]chan QueryMetrics, len(gpus))
+	for _, gpu := range gpus {
+		queryChans[gpu.Uuid] = make(chan QueryMetrics)
+	}
 
-		// sendUpdatedState helps avoid blocking during shutdown.
-		sendUpdatedState := func() {
-			select {
-			case combinedStateChan <- currentState:
-			case <-ctx.Done():
+	// All query groups of a GPU share its channel, which is closed once the last worker finished.
+	var queryWg sync.WaitGroup
+	var querySup *supervisor
+	for _, group := range n.queryGroups() {
+		switch {
+		case n.opts.QueryMode == QueryModeStream && group.adaptive:
+			querySup = newSupervisor("query-gpu", n.logger, n.queryStallTimeout(n.opts.QueryInterval))
+			querySup.onRestart = restarted
+
+			// Goroutine for the streaming query
+			queryWg.Go(func() {
+				n.runStreamQuery(ctx, gpus, group, querySup, act, queryChans)
+			})
+		case n.opts.QueryMode == QueryModeStream || n.opts.QueryMode == QueryModeBatched:
+			// Goroutine for the batched query, slow groups are polled even in stream mode
+			queryWg.Go(func() {
+				n.runBatchedQuery(ctx, gpus, group, act, queryChans, report)
+			})
+		default:
+			for _, gpu := range gpus {
+				// Goroutine for query
+				queryWg.Go(func() {
+					n.runQuery(ctx, gpu, group, act, queryChans[gpu.Uuid], report)
+				})
 			}
 		}
-		handleDmon := func(dmonData DmonMetrics, ok bool) {
-			if !ok {
-				dmonChan = nil
-				logger.Debug("dmon channel closed", "gpu_uuid", gpu.Uuid)
-				return
-			}
+	}
+	go func() {
+		queryWg.Wait()
+		for _, ch := range queryChans {
+			close(ch)
+		}
+	}()
 
-			currentState.DmonMetrics = dmonData
-			sendUpdatedState()
+	snapshotChans := make(map[string]chan Snapshot, len(gpus))
+	if n.opts.SnapshotInterval > 0 {
+		for _, gpu := range gpus {
+			snapshotChans[gpu.Uuid] = make(chan Snapshot)
 		}
-		handleQuery := func(queryData QueryMetrics, ok bool) {
-			if !ok {
-				queryChan = nil
-				logger.Debug("query channel closed", "gpu_uuid", gpu.Uuid)
-				return
-			}
 
-			currentState.QueryMetrics = queryData
-			sendUpdatedState()
+		// Goroutine for the xml snapshot
+		go func() {
+			defer func() {
+				for _, ch := range snapshotChans {
+					close(ch)
+				}
+			}()
+			n.runSnapshot(ctx, gpus, snapshotChans, report)
+		}()
+	}
+
+	memoryChans := make(map[string]chan MemoryHealth, len(gpus))
+	if n.opts.MemoryHealthInterval > 0 {
+		for _, gpu := range gpus {
+			memoryChans[gpu.Uuid] = make(chan MemoryHealth)
 		}
 
-		for {
-			if !channelsOpen() {
-				logger.Info("all channels closed, shutting down combined monitor", "gpu_uuid", gpu.Uuid)
-				return
-			}
+		// Goroutine for the memory health
+		go func() {
+			defer func() {
+				for _, ch := range memoryChans {
+					close(ch)
+				}
+			}()
+			n.runMemoryHealth(ctx, gpus, memoryChans, report)
+		}()
+	}
 
-			select {
-			case <-ctx.Done():
-				logger.Info("combined monitor context cancelled, shutting down", "gpu_uuid", gpu.Uuid)
-				return
+	xidChans := make(map[string]chan XidError, len(gpus))
+	if n.opts.XidLog != "" {
+		for _, gpu := range gpus {
+			xidChans[gpu.Uuid] = make(chan XidError)
+		}
 
-			case dmonData, ok := <-dmonChan:
-				handleDmon(dmonData, ok)
+		// Goroutine for the Xid watcher
+		go func() {
+			defer func() {
+				for _, ch := range xidChans {
+					close(ch)
+				}
+			}()
+			n.runXidWatcher(ctx, gpus, xidChans, report)
+		}()
+	}
 
-			case queryData, ok := <-queryChan:
-				handleQuery(queryData, ok)
-			}
+	var wg sync.WaitGroup
+	for _, gpu := range gpus {
+		sources := gpuSources{
+			dmon:     dmonChans[gpu.Index],
+			query:    queryChans[gpu.Uuid],
+			errors:   errChans[gpu.Uuid],
+			activity: act,
+			dmonSup:  dmonSup,
+			querySup: querySup,
+		}
+		// A nil channel never delivers, so a disabled snapshot is simply skipped.
+		if ch, found := snapshotChans[gpu.Uuid]; found {
+			sources.snapshot = ch
+		}
+		if ch, found := memoryChans[gpu.Uuid]; found {
+			sources.memory = ch
+		}
+		if ch, found := xidChans[gpu.Uuid]; found {
+			sources.xid = ch
 		}
+
+		wg.Go(func() {
+			n.mergeGpu(ctx, gpu, sources, combinedStateChan)
+		})
+	}
+
+	go func() {
+		wg.Wait()
+		close(combinedStateChan)
 	}()
 
 	return combinedStateChan, nil
 }
 
-func runQuery(ctx context.Context, logger *slog.Logger, gpu GPU, interval time.Duration, out chan<- QueryMetrics) {
-	if !isValidGPUUUID(gpu.Uuid) {
-		logger.Error("invalid GPU UUID format", "gpu_uuid", gpu.Uuid)
-		return
+// gpuSources are the worker channels feeding the state of one GPU.
+type gpuSources struct {
+	dmon     <-chan DmonMetrics
+	query    <-chan QueryMetrics
+	snapshot <-chan Snapshot
+	memory   <-chan MemoryHealth
+	xid      <-chan XidError
+	errors   <-chan error
+	activity *activity
+	dmonSup  *supervisor
+	querySup *supervisor
+}
+
+// mergeGpu merges the worker updates of one GPU into a single state stream.
+func (n *NvidiaSmi) mergeGpu(ctx context.Context, gpu GPU, sources gpuSources, out chan<- GpuState) {
+	logger := n.logger
+	dmonChan, queryChan, snapshotChan, memoryChan, xidChan := sources.dmon, sources.query, sources.snapshot, sources.memory, sources.xid
+
+	var currentState GpuState
+	currentState.Gpu = gpu
+	currentState.Health = HealthOK
+	channelsOpen := func() bool {
+		return dmonChan != nil || queryChan != nil || snapshotChan != nil || memoryChan != nil || xidChan != nil
 	}
-	const queryFields = "utilization.gpu,memory.used,memory.free,driver_version,fan.speed,pstate"
-	sendMetrics := func(metrics QueryMetrics) bool {
-		select {
-		case out <- metrics:
-			return true
-		case <-ctx.Done():
-			logger.Info("query context cancelled during send, shutting down monitor", "gpu_uuid", gpu.Uuid)
-			return false
+
+	// The counts continue where the previous monitor of the GPU stopped.
+	counters := n.loadCounters(gpu.Uuid)
+	currentState.Error = counters.error
+	if xidChan != nil {
+		currentState.Xid = counters.xid
+		if currentState.Xid == nil {
+			currentState.Xid = &XidErrors{}
 		}
 	}
+	defer func() {
+		n.storeCounters(gpu.Uuid, gpuCounters{xid: currentState.Xid, error: currentState.Error})
+	}()
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	samples := newReducer(n.opts.Reduction)
+	var link *linkWatch
+	if n.opts.PcieLink {
+		link = newLinkWatch(n.opts.PcieDegradedLoad, n.opts.PcieDegradedAfter)
+	}
+	var stats *window
+	if n.opts.StatsWindow > 0 {
+		stats = newWindow(n.opts.StatsWindow, n.opts.StatsPercentile)
+	}
+	addSamples := func(metrics map[string]Value) {
+		samples.add(metrics)
+		if stats != nil {
+			stats.add(time.Now(), metrics)
+		}
+	}
 
-	for {
+	// sendState helps avoid blocking during shutdown.
+	sendState := func(state GpuState) {
+		if stats != nil {
+			state.Stats = stats.stats(time.Now())
+		}
 		select {
+		case out <- state:
 		case <-ctx.Done():
+		}
+	}
+
+	// With a publish interval updates are only collected and emitted on the ticker.
+	var publishTick <-chan time.Time
+	updated := false
+	if n.opts.PublishInterval > 0 {
+		ticker := time.NewTicker(n.opts.PublishInterval)
+		defer ticker.Stop()
+		publishTick = ticker.C
+	}
+	// With runtime PM the power state is followed in sysfs, where reading it
+	// does not wake the GPU.
+	var powerTick <-chan time.Time
+	var suspendedSent time.Time
+	slowKeys := n.slowQueryKeys()
+	if n.opts.RuntimePM {
+		ticker := time.NewTicker(powerStateInterval)
+		defer ticker.Stop()
+		powerTick = ticker.C
+		currentState.PowerState = n.powerState(gpu)
+	}
+
+	sendUpdatedState := func() {
+		if publishTick == nil {
+			sendState(currentState)
 			return
-		case <-ticker.C:
-			cmd := exec.CommandContext(
-				ctx,
-				"nvidia-smi",
-				"--query-gpu="+queryFields,
-				"--format=csv,noheader,nounits",
-				"-i",
-				gpu.Uuid,
-			)
-
-			output, err := cmd.Output()
-			if err != nil {
-				logger.Error("failed to run query-gpu", "gpu_uuid", gpu.Uuid, "error", err)
-				continue
-			}
+		}
+		updated = true
+	}
+	handleDmon := func(dmonData DmonMetrics, ok bool) {
+		if !ok {
+			dmonChan = nil
+			logger.Debug("dmon channel closed", "gpu_uuid", gpu.Uuid)
+			return
+		}
 
-			metrics := parseQueryLine(string(output))
-			if !sendMetrics(metrics) {
-				return
-			}
+		currentState.DmonMetrics = dmonData
+		currentState.DmonSampledAt = dmonData.SampledAt
+		sources.activity.observe(dmonData.Sm)
+		metrics := dmonData.Metrics()
+		// Without a queried draw the percentage follows the dmon power.
+		if n.opts.PowerLimitPercent && usesDmonPower(currentState.QueryMetrics) {
+			query := maps.Clone(currentState.QueryMetrics)
+			query[PowerLimitPercentKey] = powerLimitPercent(query, dmonData.Pwr)
+			currentState.QueryMetrics = query
+			metrics["query."+PowerLimitPercentKey] = query[PowerLimitPercentKey]
 		}
+		addSamples(metrics)
+		currentState.Health = HealthOK
+		currentState.DmonRestarts = sources.dmonSup.Restarts()
+		sendUpdatedState()
 	}
-}
+	handleQuery := func(queryData QueryMetrics, ok bool) {
+		if !ok {
+			queryChan = nil
+			logger.Debug("query channel closed", "gpu_uuid", gpu.Uuid)
+			return
+		}
 
-func runDmon(ctx context.Context, logger *slog.Logger, gpu GPU, intervalSeconds int, out chan<- DmonMetrics) {
-	if !isValidGPUUUID(gpu.Uuid) {
-		logger.Error("invalid GPU UUID format", "gpu_uuid", gpu.Uuid)
-		return
+		// Query groups deliver their fields separately. Merge them into a new
+		// map, as states sent earlier share the current one.
+		merged := maps.Clone(currentState.QueryMetrics)
+		if merged == nil {
+			merged = make(QueryMetrics, len(queryData))
+		}
+		maps.Copy(merged, queryData)
+		// The limits and the draw may be polled in different groups, so the
+		// percentage is derived from the merged fields. queryData is not
+		// shared yet and takes it too, to be sampled with the group.
+		if n.opts.PowerLimitPercent && hasPowerKey(queryData) {
+			merged[PowerLimitPercentKey] = powerLimitPercent(merged, currentState.DmonMetrics.Pwr)
+			queryData[PowerLimitPercentKey] = merged[PowerLimitPercentKey]
+		}
+		currentState.QueryMetrics = merged
+		currentState.QuerySampledAt = time.Now()
+		if _, found := queryData[pcieGenCurrent]; found && link != nil {
+			currentState.PcieLinkDegraded = link.observe(currentState.QuerySampledAt, merged["utilgpu"], merged)
+		}
+		sources.activity.observe(queryData["utilgpu"])
+		addSamples(queryData.Metrics())
+		currentState.Health = HealthOK
+		if sources.querySup != nil {
+			currentState.QueryRestarts = sources.querySup.Restarts()
+		}
+		sendUpdatedState()
 	}
-	intervalStr := strconv.Itoa(intervalSeconds)
-	cmd := exec.CommandContext(ctx, "nvidia-smi", "dmon", "-d", intervalStr, "-s", "pucvmet", "--format", "csv,noheader,nounit", "-i", gpu.Uuid)
+	handleSnapshot := func(snapshot Snapshot, ok bool) {
+		if !ok {
+			snapshotChan = nil
+			logger.Debug("snapshot channel closed", "gpu_uuid", gpu.Uuid)
+			return
+		}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		logger.Error("failed to create dmon stdout pipe", "gpu_uuid", gpu.Uuid, "error", err)
-		return
+		currentState.Snapshot = &snapshot
+		currentState.Health = HealthOK
+		sendUpdatedState()
 	}
+	handleMemory := func(memory MemoryHealth, ok bool) {
+		if !ok {
+			memoryChan = nil
+			logger.Debug("memory health channel closed", "gpu_uuid", gpu.Uuid)
+			return
+		}
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		logger.Error("failed to create dmon stderr pipe", "gpu_uuid", gpu.Uuid, "error", err)
-		return
+		currentState.Memory = &memory
+		sendUpdatedState()
 	}
+	handleXid := func(xid XidError, ok bool) {
+		if !ok {
+			xidChan = nil
+			logger.Debug("xid channel closed", "gpu_uuid", gpu.Uuid)
+			return
+		}
 
-	err = cmd.Start()
-	if err != nil {
-		logger.Error("failed to start dmon", "gpu_uuid", gpu.Uuid, "error", err)
-		return
+		// Replace instead of update, states sent earlier share the pointer.
+		currentState.Xid = &XidErrors{Count: currentState.Xid.Count + 1, Last: &xid}
+		// Each Xid is published as event, so its state skips the publish
+		// ticker, which would only pass on the last Xid of an interval.
+		sendState(currentState)
 	}
+	handlePowerState := func() {
+		state := n.powerState(gpu)
+		if state == currentState.PowerState {
+			// A suspended GPU delivers no updates, repeat its state at the
+			// dmon interval so it is still force published.
+			if state == PowerStateSuspended && time.Since(suspendedSent) >= time.Duration(n.opts.DmonInterval)*time.Second {
+				suspendedSent = time.Now()
+				sendUpdatedState()
+			}
+			return
+		}
 
-	defer func() {
-		if waitErr := cmd.Wait(); waitErr != nil && ctx.Err() == nil {
-			logger.Error("dmon process exited with error", "gpu_uuid", gpu.Uuid, "error", waitErr)
+		logger.Info("gpu power state changed", "gpu_uuid", gpu.Uuid, "power_state", state)
+		currentState.PowerState = state
+		if state == PowerStateSuspended {
+			// The last readings are outdated, publish them as missing. Slow
+			// groups such as the driver version stay, as they would be
+			// missing until their next poll.
+			currentState.DmonMetrics = DmonMetrics{Id: gpu.Index}
+			var kept QueryMetrics
+			for _, key := range slowKeys {
+				if value, found := currentState.QueryMetrics[key]; found {
+					if kept == nil {
+						kept = make(QueryMetrics, len(slowKeys))
+					}
+					kept[key] = value
+				}
+			}
+			currentState.QueryMetrics = kept
+			// Samples taken before the suspend would fill them in again on
+			// the next publish tick.
+			samples.reset()
+			if stats != nil {
+				stats.reset()
+			}
+			suspendedSent = time.Now()
 		}
-	}()
-	// Goroutine for error readout
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			logger.Error("dmon process error", "gpu_uuid", gpu.Uuid, "error", scanner.Text())
+		sendUpdatedState()
+	}
+	handleError := func(err error) {
+		// Replace instead of update, states sent earlier share the pointer.
+		gpuErr := GpuError{Message: err.Error(), Count: 1, Timestamp: time.Now()}
+		if currentState.Error != nil {
+			gpuErr.Count += currentState.Error.Count
 		}
-		if scanErr := scanner.Err(); scanErr != nil && ctx.Err() == nil {
-			logger.Error("failed to read dmon stderr", "gpu_uuid", gpu.Uuid, "error", scanErr)
+		currentState.Error = &gpuErr
+		if health := classifyError(err); health.Fatal() {
+			currentState.Health = health
 		}
-	}()
+		sendUpdatedState()
+	}
 
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		line := scanner.Text()
-		metrics := parseDmonLine(line)
+	// A suspended GPU delivers no metrics, publish its state right away.
+	if currentState.PowerState == PowerStateSuspended {
+		suspendedSent = time.Now()
+		sendUpdatedState()
+	}
+
+	for {
+		if !channelsOpen() {
+			logger.Info("all channels closed, shutting down combined monitor", "gpu_uuid", gpu.Uuid)
+			return
+		}
 
 		select {
-		case out <- metrics:
 		case <-ctx.Done():
-			logger.Info("dmon context cancelled during send, shutting down monitor", "gpu_uuid", gpu.Uuid)
+			logger.Info("combined monitor context cancelled, shutting down", "gpu_uuid", gpu.Uuid)
 			return
-		}
-	}
 
-	if scanErr := scanner.Err(); scanErr != nil && ctx.Err() == nil {
-		logger.Error("failed to read dmon stdout", "gpu_uuid", gpu.Uuid, "error", scanErr)
-	}
-	logger.Info("dmon process finished, shutting down monitor", "gpu_uuid", gpu.Uuid)
-}
+		case dmonData, ok := <-dmonChan:
+			handleDmon(dmonData, ok)
 
-func parseInt(s string) int {
-	val := strings.TrimSpace(s)
-	if val == "-" {
-		return 0
-	}
-	i, err := strconv.Atoi(val)
-	if err != nil {
-		return 0
+		case queryData, ok := <-queryChan:
+			handleQuery(queryData, ok)
+
+		case snapshot, ok := <-snapshotChan:
+			handleSnapshot(snapshot, ok)
+
+		case memory, ok := <-memoryChan:
+			handleMemory(memory, ok)
+
+		case xid, ok := <-xidChan:
+			handleXid(xid, ok)
+
+		case err := <-sources.errors:
+			handleError(err)
+
+		case <-powerTick:
+			handlePowerState()
+
+		case <-publishTick:
+			if updated {
+				updated = false
+				sendState(samples.apply(currentState))
+			}
+		}
 	}
-	return i
 }
 
-func parseDmonLine(line string) DmonMetrics {
-	parts := strings.Split(line, ",")
-	if len(parts) != 22 {
-		return DmonMetrics{}
-	}
-
-	metrics := DmonMetrics{
-		Id:    parseInt(parts[0]),
-		Pwr:   parseInt(parts[1]),
-		Gtemp: parseInt(parts[2]),
-		Mtemp: parseInt(parts[3]),
-		Sm:    parseInt(parts[4]),
-		Mem:   parseInt(parts[5]),
-		Enc:   parseInt(parts[6]),
-		Dec:   parseInt(parts[7]),
-		Jpg:   parseInt(parts[8]),
-		Ofa:   parseInt(parts[9]),
-		Mclk:  parseInt(parts[10]),
-		Pclk:  parseInt(parts[11]),
-		Pviol: parseInt(parts[12]),
-		Tviol: parseInt(parts[13]),
-		Fb:    parseInt(parts[14]),
-		Bar1:  parseInt(parts[15]),
-		Ccpm:  parseInt(parts[16]),
-		Sbecc: parseInt(parts[17]),
-		Dbecc: parseInt(parts[18]),
-		Pci:   parseInt(parts[19]),
-		Rxpci: parseInt(parts[20]),
-		Txpci: parseInt(parts[21]),
-	}
-
-	return metrics
-}
+// reportFunc passes a worker error to the merge loops of targets, see reportError.
+type reportFunc func(err error, targets ...GPU)
 
-func parseQueryLine(line string) QueryMetrics {
-	parts := strings.Split(strings.TrimSpace(line), ",")
-	if len(parts) != 6 {
-		return QueryMetrics{}
+// reportError hands err to the merge loops of targets. Without targets it
+// goes to the GPUs a fatal message names, or else to all gpus, as a failed
+// call shared by several GPUs does not tell which one caused it. Targets of
+// a lost error are left out of shared calls from then on.
+func (n *NvidiaSmi) reportError(ctx context.Context, gpus []GPU, outs map[string]chan error, err error, targets ...GPU) {
+	if len(targets) == 0 {
+		targets = fatalGpus(err.Error(), gpus)
+	}
+	if len(targets) == 0 {
+		targets = gpus
+	} else if classifyError(err) == HealthGpuLost {
+		for _, gpu := range targets {
+			if _, loaded := n.lost.LoadOrStore(gpu.Uuid, true); !loaded {
+				n.logger.Warn("leaving lost gpu out of shared calls", "gpu_uuid", gpu.Uuid)
+			}
+		}
 	}
 
-	return QueryMetrics{
-		UtilGpu: parseInt(parts[0]),
-		MemUsed: parseInt(parts[1]),
-		MemFree: parseInt(parts[2]),
-		DrivVer: strings.TrimSpace(parts[3]),
-		FanSpe:  parseInt(parts[4]),
-		Pstat:   strings.TrimSpace(parts[5]),
+	for _, gpu := range targets {
+		select {
+		case outs[gpu.Uuid] <- err:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -0,0 +1,174 @@
+package gpuinfo
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testGpus = []GPU{
+	{Index: 0, Name: "NVIDIA GeForce RTX 4090", Uuid: "GPU-11111111-2222-3333-4444-555555555555", PciBusId: "0000:01:00.0"},
+	{Index: 1, Name: "NVIDIA GeForce RTX 3060", Uuid: "GPU-66666666-7777-8888-9999-aaaaaaaaaaaa", PciBusId: "0000:02:00.0"},
+}
+
+// collectStates reads states until done accepted the last state of every
+// GPU or the timeout passed, and returns the last state per UUID.
+func collectStates(t *testing.T, states <-chan GpuState, done func(GpuState) bool) map[string]GpuState {
+	t.Helper()
+	last := make(map[string]GpuState)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case state, ok := <-states:
+			if !ok {
+				t.Fatal("monitor stopped early")
+			}
+			last[state.Gpu.Uuid] = state
+			finished := len(last) == len(testGpus)
+			for _, state := range last {
+				finished = finished && done(state)
+			}
+			if finished {
+				return last
+			}
+		case <-timeout:
+			t.Fatalf("no complete states before the timeout, got %+v", last)
+		}
+	}
+}
+
+func TestCombinedMonitor(t *testing.T) {
+	runner := &replayRunner{replays: []replay{
+		{match: "dmon", stdout: fixture(t, "dmon.csv"), stream: true},
+		{match: "-i " + testGpus[0].Uuid, stdout: "35, 1024, 23552, 550.54.15, 30, P2\n"},
+		{match: "-i " + testGpus[1].Uuid, stdout: "0, 3, 12285, 550.54.15, [N/A], P8\n"},
+	}}
+	n := NewNvidiaSmi(runner, slog.New(slog.DiscardHandler), Options{
+		DmonInterval:    1,
+		DmonStallFactor: 5,
+		QueryInterval:   20 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	states, err := n.CombinedMonitor(ctx, testGpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := collectStates(t, states, func(state GpuState) bool {
+		return state.DmonMetrics.Pwr.Valid() && state.QueryMetrics["utilgpu"].Valid()
+	})
+	tests := []struct {
+		gpu     GPU
+		pwr     float64
+		utilgpu float64
+		fanspe  Value
+	}{
+		{testGpus[0], 72, 35, NewValue(30)},
+		{testGpus[1], 18, 0, Value{Status: ValueUnavailable}},
+	}
+	for _, tt := range tests {
+		state := last[tt.gpu.Uuid]
+		if state.Health != HealthOK {
+			t.Errorf("%s: health = %q, want ok", tt.gpu.Name, state.Health)
+		}
+		if state.DmonMetrics.Pwr.Num != tt.pwr {
+			t.Errorf("%s: dmon pwr = %v, want %v", tt.gpu.Name, state.DmonMetrics.Pwr.Num, tt.pwr)
+		}
+		if state.QueryMetrics["utilgpu"].Num != tt.utilgpu {
+			t.Errorf("%s: utilgpu = %v, want %v", tt.gpu.Name, state.QueryMetrics["utilgpu"].Num, tt.utilgpu)
+		}
+		if state.QueryMetrics["fanspe"] != tt.fanspe {
+			t.Errorf("%s: fanspe = %+v, want %+v", tt.gpu.Name, state.QueryMetrics["fanspe"], tt.fanspe)
+		}
+		if state.QueryMetrics["drivver"].Text != "550.54.15" {
+			t.Errorf("%s: drivver = %+v, want 550.54.15", tt.gpu.Name, state.QueryMetrics["drivver"])
+		}
+	}
+}
+
+func TestCombinedMonitorLostGpu(t *testing.T) {
+	lost := "Unable to determine the device handle for GPU00000000:02:00.0: GPU is lost.  Reboot the system to recover this GPU\n"
+	both := testGpus[0].Uuid + "," + testGpus[1].Uuid
+	query := "--query-gpu=uuid," + queryProperties(DefaultQueryFields) + " --format=csv,noheader,nounits -i "
+	runner := &replayRunner{replays: []replay{
+		{match: "dmon", stdout: fixture(t, "dmon.csv"), stream: true},
+		{match: "-i " + both, stdout: lost, code: exitGpuLost},
+		{match: "-i " + testGpus[0].Uuid, stdout: testGpus[0].Uuid + ", 35, 1024, 23552, 550.54.15, 30, P2\n"},
+		{match: "-i " + testGpus[1].Uuid, stdout: lost, code: exitGpuLost},
+	}}
+	n := NewNvidiaSmi(runner, slog.New(slog.DiscardHandler), Options{
+		DmonInterval:    1,
+		DmonStallFactor: 5,
+		QueryInterval:   20 * time.Millisecond,
+		QueryMode:       QueryModeBatched,
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	states, err := n.CombinedMonitor(ctx, testGpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := collectStates(t, states, func(state GpuState) bool {
+		if state.Gpu.Uuid == testGpus[1].Uuid {
+			return state.Health == HealthGpuLost
+		}
+		return state.QueryMetrics["utilgpu"].Valid()
+	})
+	if health := last[testGpus[0].Uuid].Health; health != HealthOK {
+		t.Errorf("healthy gpu: health = %q, want ok", health)
+	}
+
+	// Once lost, the GPU is left out of the batched call.
+	deadline := time.Now().Add(5 * time.Second)
+	for !runner.called(query + testGpus[0].Uuid) {
+		if time.Now().After(deadline) {
+			t.Fatal("lost gpu was not left out of the batched query")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCombinedMonitorPowerLimitGroups(t *testing.T) {
+	limits := []string{"power.limit", "enforced.power.limit", "power.default_limit", "power.min_limit", "power.max_limit"}
+	query := "--query-gpu=" + strings.Join(limits, ",") + " --format=csv,noheader,nounits -i "
+	runner := &replayRunner{replays: []replay{
+		{match: "dmon", stdout: fixture(t, "dmon.csv"), stream: true},
+		{match: query + testGpus[0].Uuid, stdout: "300.00, 300.00, 300.00, 100.00, 300.00\n"},
+		{match: query + testGpus[1].Uuid, stdout: "170.00, 170.00, 170.00, 100.00, 212.00\n"},
+		{match: "-i " + testGpus[0].Uuid, stdout: "35, 1024, 23552, 550.54.15, 30, P2, 150.00, 161.20\n"},
+		{match: "-i " + testGpus[1].Uuid, stdout: "0, 3, 12285, 550.54.15, [N/A], P8, 17.00, 16.80\n"},
+	}}
+	// The limits are polled hourly, the draw with the default fields.
+	n := NewNvidiaSmi(runner, slog.New(slog.DiscardHandler), Options{
+		DmonInterval:      1,
+		DmonStallFactor:   5,
+		QueryInterval:     20 * time.Millisecond,
+		QueryFields:       append(slices.Clone(DefaultQueryFields), PowerFields...),
+		QueryGroups:       []QueryGroup{{Name: "limits", Interval: 3600, Properties: limits}},
+		PowerLimitPercent: true,
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	states, err := n.CombinedMonitor(ctx, testGpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{testGpus[0].Uuid: 50, testGpus[1].Uuid: 10}
+	last := collectStates(t, states, func(state GpuState) bool {
+		return state.QueryMetrics[PowerLimitPercentKey] == NewValue(want[state.Gpu.Uuid])
+	})
+	for uuid, state := range last {
+		if !state.QueryMetrics[enforcedPowerLimit].Valid() || !state.QueryMetrics[powerDrawAverage].Valid() {
+			t.Errorf("%s: query metrics = %v, want the limits and the draw", uuid, state.QueryMetrics)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package gpuinfo
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Health is the condition of a GPU derived from nvidia-smi failures.
+type Health string
+
+const (
+	// HealthOK means the GPU delivers metrics.
+	HealthOK Health = "ok"
+	// HealthGpuLost means the GPU has fallen off the bus, the host needs a reboot.
+	HealthGpuLost Health = "gpu_lost"
+	// HealthDriverMismatch means the kernel module and the NVML library differ,
+	// usually after a driver update without reboot.
+	HealthDriverMismatch Health = "driver_mismatch"
+	// HealthDriverNotLoaded means nvidia-smi cannot talk to the kernel module.
+	HealthDriverNotLoaded Health = "driver_not_loaded"
+)
+
+// Fatal reports whether h is a condition that does not recover on its own.
+func (h Health) Fatal() bool {
+	return h != HealthOK && h != ""
+}
+
+// nvidia-smi exit codes of fatal conditions, see "man nvidia-smi".
+const (
+	exitDriverNotLoaded = 9
+	exitGpuLost         = 15
+)
+
+// classifyError derives the health from the exit code and the message of a failed call.
+func classifyError(err error) Health {
+	switch exitCode(err) {
+	case exitGpuLost:
+		return HealthGpuLost
+	case exitDriverNotLoaded:
+		return HealthDriverNotLoaded
+	}
+	return classifyMessage(err.Error())
+}
+
+// classifyMessage recognizes the messages nvidia-smi prints for fatal conditions.
+func classifyMessage(msg string) Health {
+	msg = strings.ToLower(msg)
+	switch {
+	case strings.Contains(msg, "gpu is lost"), strings.Contains(msg, "fallen off the bus"):
+		return HealthGpuLost
+	case strings.Contains(msg, "driver/library version mismatch"):
+		return HealthDriverMismatch
+	case strings.Contains(msg, "couldn't communicate with the nvidia driver"):
+		return HealthDriverNotLoaded
+	}
+	return HealthOK
+}
+
+var (
+	uuidPattern  = regexp.MustCompile(`GPU-[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	busIdPattern = regexp.MustCompile(`[0-9a-fA-F]{4,8}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]`)
+)
+
+// fatalGpus returns the gpus named by UUID or PCI bus id in the lines of msg
+// that describe a fatal condition, e.g. "Unable to determine the device
+// handle for GPU0000:02:00.0: GPU is lost". Calls for several GPUs fail as a
+// whole, this tells which GPU caused it.
+func fatalGpus(msg string, gpus []GPU) []GPU {
+	var named []GPU
+	for line := range strings.Lines(msg) {
+		if !classifyMessage(line).Fatal() {
+			continue
+		}
+		for _, gpu := range gpus {
+			if strings.Contains(line, gpu.Uuid) || gpu.PciBusId != "" && containsBusId(line, gpu.PciBusId) {
+				named = append(named, gpu)
+			}
+		}
+	}
+	return named
+}
+
+// containsBusId reports whether line mentions the sysfs form busId in any
+// of the notations used by nvidia-smi.
+func containsBusId(line, busId string) bool {
+	for _, match := range busIdPattern.FindAllString(line, -1) {
+		if normalizeBusId(match) == busId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package gpuinfo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Memory health states, from the best to the worst.
+const (
+	// MemoryHealthOK means no memory repair is outstanding.
+	MemoryHealthOK = "ok"
+	// MemoryHealthRemapPending means rows or pages are waiting to be remapped
+	// or retired, which happens with the next GPU reset.
+	MemoryHealthRemapPending = "remap_pending"
+	// MemoryHealthNeedsReset means an uncorrectable ECC error occurred since
+	// the last reset, the GPU should be reset before it is trusted again.
+	MemoryHealthNeedsReset = "needs_reset"
+	// MemoryHealthFailed means row remapping failed, the GPU needs service.
+	MemoryHealthFailed = "failed"
+)
+
+// MemoryHealth is the ECC, page retirement and row remapping view of a GPU.
+type MemoryHealth struct {
+	State        string       `json:"state"`
+	Ecc          EccErrors    `json:"ecc"`
+	RetiredPages RetiredPages `json:"retired_pages"`
+	RemappedRows RemappedRows `json:"remapped_rows"`
+}
+
+// memoryEccProperties are read with query-gpu, the counts are totals over all memory locations.
+var memoryEccProperties = []string{
+	"ecc.mode.current",
+	"ecc.errors.corrected.volatile.total",
+	"ecc.errors.uncorrected.volatile.total",
+	"ecc.errors.corrected.aggregate.total",
+	"ecc.errors.uncorrected.aggregate.total",
+	"retired_pages.pending",
+}
+
+var remappedRowsProperties = []string{
+	"remapped_rows.correctable",
+	"remapped_rows.uncorrectable",
+	"remapped_rows.pending",
+	"remapped_rows.failure",
+	"remapped_rows.histogram.max",
+	"remapped_rows.histogram.high",
+	"remapped_rows.histogram.partial",
+	"remapped_rows.histogram.low",
+	"remapped_rows.histogram.none",
+}
+
+// exitNotSupported is the nvidia-smi exit code of an operation the GPU does not support.
+const exitNotSupported = 3
+
+// Causes listed by --query-retired-pages.
+const (
+	retiredCauseSingleBit = "single bit ecc"
+	retiredCauseDoubleBit = "double bit ecc"
+)
+
+// deriveState sets the memory health state from the worst condition found.
+// Unsupported readings count as fine, e.g. on GPUs without row remapping.
+func (m *MemoryHealth) deriveState() {
+	isTrue := func(v Value) bool { return v.Valid() && v.Bool && v.Num != 0 }
+
+	switch {
+	case isTrue(m.RemappedRows.Failure):
+		m.State = MemoryHealthFailed
+	case m.Ecc.VolatileUncorrected.Valid() && m.Ecc.VolatileUncorrected.Num > 0:
+		m.State = MemoryHealthNeedsReset
+	case isTrue(m.RemappedRows.Pending) || isTrue(m.RetiredPages.Pending):
+		m.State = MemoryHealthRemapPending
+	default:
+		m.State = MemoryHealthOK
+	}
+}
+
+// runMemoryHealth polls the ECC counters, retired pages and remapped rows of
+// gpus on the memory health interval and sends the result of each GPU to its
+// channel, keyed by UUID. Failures are passed to report.
+func (n *NvidiaSmi) runMemoryHealth(ctx context.Context, gpus []GPU, outs map[string]chan MemoryHealth, report reportFunc) {
+	logger := n.logger
+	ticker := time.NewTicker(n.opts.MemoryHealthInterval)
+	defer ticker.Stop()
+	var br breaker
+
+	poll := func() bool {
+		active := n.activeGpus(gpus)
+		if !br.allow() || len(active) == 0 {
+			return true
+		}
+
+		healths, err := n.memoryHealth(ctx, active)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			logger.Error("failed to read memory health", "error", err)
+			if backoff := br.failure(); backoff > 0 {
+				logger.Warn("pausing memory health after repeated failures", "backoff", backoff)
+			}
+			report(fmt.Errorf("memory health: %w", err))
+		} else {
+			br.success()
+		}
+
+		// Send what was read, a failed call leaves its readings missing.
+		for uuid, health := range healths {
+			health.deriveState()
+			select {
+			case outs[uuid] <- health:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		return true
+	}
+
+	// The counters change rarely, so read them right away.
+	if !poll() {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !poll() {
+				return
+			}
+		}
+	}
+}
+
+// memoryHealth runs the three memory queries for gpus. A failed query leaves
+// its readings missing and its error is returned, the others still run.
+func (n *NvidiaSmi) memoryHealth(ctx context.Context, gpus []GPU) (map[string]MemoryHealth, error) {
+	var errs []error
+	healths := make(map[string]MemoryHealth, len(gpus))
+	for _, gpu := range gpus {
+		healths[gpu.Uuid] = MemoryHealth{}
+	}
+
+	rows, err := n.memoryRows(ctx, gpus, "--query-gpu=uuid,"+strings.Join(memoryEccProperties, ","), "--format=csv,noheader,nounits")
+	errs = append(errs, err)
+	for uuid, values := range firstRows(rows, len(memoryEccProperties)) {
+		health := healths[uuid]
+		health.Ecc = EccErrors{
+			Mode:                 parseText(values[0]),
+			VolatileCorrected:    parseValue(values[1]),
+			VolatileUncorrected:  parseValue(values[2]),
+			AggregateCorrected:   parseValue(values[3]),
+			AggregateUncorrected: parseValue(values[4]),
+		}
+		health.RetiredPages.Pending = parseBool(values[5])
+		healths[uuid] = health
+	}
+
+	// Each retired page is one row, GPUs without a row have none retired.
+	rows, err = n.memoryRows(ctx, gpus, "--query-retired-pages=gpu_uuid,retired_pages.cause", "--format=csv,noheader")
+	errs = append(errs, err)
+	if err == nil && rows != nil {
+		for uuid, health := range healths {
+			var singleBit, doubleBit float64
+			for _, values := range rows[uuid] {
+				switch strings.ToLower(strings.TrimSpace(values[0])) {
+				case retiredCauseSingleBit:
+					singleBit++
+				case retiredCauseDoubleBit:
+					doubleBit++
+				}
+			}
+			health.RetiredPages.SingleBit = NewValue(singleBit)
+			health.RetiredPages.DoubleBit = NewValue(doubleBit)
+			healths[uuid] = health
+		}
+	}
+
+	rows, err = n.memoryRows(ctx, gpus, "--query-remapped-rows=gpu_uuid,"+strings.Join(remappedRowsProperties, ","), "--format=csv,noheader,nounits")
+	errs = append(errs, err)
+	for uuid, values := range firstRows(rows, len(remappedRowsProperties)) {
+		health := healths[uuid]
+		health.RemappedRows = RemappedRows{
+			Correctable:   parseValue(values[0]),
+			Uncorrectable: parseValue(values[1]),
+			Pending:       parseBool(values[2]),
+			Failure:       parseBool(values[3]),
+			HistogramMax:  parseValue(values[4]),
+			HistogramHigh: parseValue(values[5]),
+			HistogramPart: parseValue(values[6]),
+			HistogramLow:  parseValue(values[7]),
+			HistogramNone: parseValue(values[8]),
+		}
+		healths[uuid] = health
+	}
+
+	return healths, errors.Join(errs...)
+}
+
+// memoryRows runs one query for gpus and groups the values after the
+// leading uuid column by GPU. Rows of unknown GPUs are dropped. A query the
+// GPUs do not support returns no rows, e.g. remapped rows before Ampere.
+func (n *NvidiaSmi) memoryRows(ctx context.Context, gpus []GPU, args ...string) (map[string][][]string, error) {
+	output, err := n.output(ctx, append(args, "-i", gpuUuids(gpus))...)
+	if exitCode(err) == exitNotSupported {
+		n.logger.Debug("memory query not supported", "query", args[0])
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make(map[string][][]string, len(gpus))
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		uuid, rest, found := strings.Cut(scanner.Text(), ",")
+		if !found {
+			continue
+		}
+		uuid = strings.TrimSpace(uuid)
+		if !slices.ContainsFunc(gpus, func(gpu GPU) bool { return gpu.Uuid == uuid }) {
+			continue
+		}
+		rows[uuid] = append(rows[uuid], strings.Split(rest, ","))
+	}
+	return rows, nil
+}
+
+// firstRows returns the first row of each GPU if it has the given number of values.
+func firstRows(rows map[string][][]string, columns int) map[string][]string {
+	first := make(map[string][]string, len(rows))
+	for uuid, values := range rows {
+		if len(values[0]) == columns {
+			first[uuid] = values[0]
+		}
+	}
+	return first
+}
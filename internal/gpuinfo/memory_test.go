@@ -0,0 +1,141 @@
+package gpuinfo
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestDeriveState(t *testing.T) {
+	tests := []struct {
+		name   string
+		health MemoryHealth
+		want   string
+	}{
+		{"no readings", MemoryHealth{}, MemoryHealthOK},
+		{
+			name:   "corrected errors only",
+			health: MemoryHealth{Ecc: EccErrors{VolatileCorrected: NewValue(12), VolatileUncorrected: NewValue(0)}},
+			want:   MemoryHealthOK,
+		},
+		{
+			name:   "unsupported remapping",
+			health: MemoryHealth{RemappedRows: RemappedRows{Pending: Value{Status: ValueUnsupported}, Failure: Value{Status: ValueUnsupported}}},
+			want:   MemoryHealthOK,
+		},
+		{
+			name:   "pending page retirement",
+			health: MemoryHealth{RetiredPages: RetiredPages{Pending: parseBool("Yes")}},
+			want:   MemoryHealthRemapPending,
+		},
+		{
+			name:   "pending row remapping",
+			health: MemoryHealth{RemappedRows: RemappedRows{Pending: parseBool("Yes"), Failure: parseBool("No")}},
+			want:   MemoryHealthRemapPending,
+		},
+		{
+			name: "uncorrectable error since reset",
+			health: MemoryHealth{
+				Ecc:          EccErrors{VolatileUncorrected: NewValue(1)},
+				RemappedRows: RemappedRows{Pending: parseBool("Yes")},
+			},
+			want: MemoryHealthNeedsReset,
+		},
+		{
+			name: "failed remapping",
+			health: MemoryHealth{
+				Ecc:          EccErrors{VolatileUncorrected: NewValue(1)},
+				RemappedRows: RemappedRows{Pending: parseBool("Yes"), Failure: parseBool("Yes")},
+			},
+			want: MemoryHealthFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.health.deriveState()
+			if tt.health.State != tt.want {
+				t.Errorf("state = %q, want %q", tt.health.State, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryHealth(t *testing.T) {
+	ecc := replay{match: "--query-gpu=uuid,ecc", stdout: fixture(t, "memory-ecc.csv")}
+	retired := replay{match: "--query-retired-pages", stdout: fixture(t, "memory-retired.csv")}
+	remapped := replay{match: "--query-remapped-rows", stdout: fixture(t, "memory-remapped.csv")}
+	unsupported := replay{match: "--query-remapped-rows", stdout: "This operation is not supported on the selected GPU.", code: exitNotSupported}
+	failed := replay{match: "--query-retired-pages", stdout: "Unknown Error", code: 1}
+
+	tests := []struct {
+		name    string
+		replays []replay
+		wantErr bool
+		// retired is the number of single and double bit retired pages of
+		// the first GPU, nil if unknown.
+		retired  []float64
+		remapped bool
+		states   []string
+	}{
+		{
+			name:     "all queries",
+			replays:  []replay{ecc, retired, remapped},
+			retired:  []float64{2, 1},
+			remapped: true,
+			states:   []string{MemoryHealthRemapPending, MemoryHealthOK},
+		},
+		{
+			name:    "row remapping not supported",
+			replays: []replay{ecc, retired, unsupported},
+			retired: []float64{2, 1},
+			states:  []string{MemoryHealthOK, MemoryHealthOK},
+		},
+		{
+			name:     "failed query",
+			replays:  []replay{ecc, failed, remapped},
+			wantErr:  true,
+			remapped: true,
+			states:   []string{MemoryHealthRemapPending, MemoryHealthOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNvidiaSmi(&replayRunner{replays: tt.replays}, slog.New(slog.DiscardHandler), Options{})
+			healths, err := n.memoryHealth(t.Context(), testGpus)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+
+			first := healths[testGpus[0].Uuid]
+			if first.Ecc.AggregateCorrected != NewValue(14) || first.Ecc.AggregateUncorrected != NewValue(1) {
+				t.Errorf("ecc = %+v, want 14 corrected and 1 uncorrected aggregate errors", first.Ecc)
+			}
+			if tt.retired == nil {
+				if first.RetiredPages.SingleBit.Valid() || first.RetiredPages.DoubleBit.Valid() {
+					t.Errorf("retired pages = %+v, want them missing", first.RetiredPages)
+				}
+			} else if first.RetiredPages.SingleBit != NewValue(tt.retired[0]) || first.RetiredPages.DoubleBit != NewValue(tt.retired[1]) {
+				t.Errorf("retired pages = %+v, want %v", first.RetiredPages, tt.retired)
+			}
+			if first.RemappedRows.Uncorrectable.Valid() != tt.remapped {
+				t.Errorf("remapped rows = %+v, want them present %v", first.RemappedRows, tt.remapped)
+			}
+
+			// The second GPU reports no ECC and has no retired pages.
+			second := healths[testGpus[1].Uuid]
+			if second.Ecc.Mode.Valid() {
+				t.Errorf("ecc mode of second gpu = %+v, want missing", second.Ecc.Mode)
+			}
+			if tt.retired != nil && second.RetiredPages.SingleBit != NewValue(0) {
+				t.Errorf("retired pages of second gpu = %+v, want none", second.RetiredPages)
+			}
+
+			for i, want := range tt.states {
+				health := healths[testGpus[i].Uuid]
+				health.deriveState()
+				if health.State != want {
+					t.Errorf("state of gpu %d = %q, want %q", i, health.State, want)
+				}
+			}
+		})
+	}
+}
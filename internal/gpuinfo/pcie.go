@@ -0,0 +1,63 @@
+package gpuinfo
+
+import "time"
+
+// Payload keys of PcieLinkFields.
+const (
+	pcieGenCurrent   = "pcie_link_gen_current"
+	pcieGenMax       = "pcie_link_gen_max"
+	pcieWidthCurrent = "pcie_link_width_current"
+	pcieWidthMax     = "pcie_link_width_max"
+)
+
+// linkWatch decides whether the PCIe link of a GPU is degraded. Idle GPUs
+// down-train their link to save power, so a reduced link only counts while
+// the GPU is under load, and only once it stayed reduced for a while.
+type linkWatch struct {
+	load  float64
+	after time.Duration
+
+	reducedSince time.Time
+	degraded     *bool
+}
+
+func newLinkWatch(load float64, after time.Duration) *linkWatch {
+	return &linkWatch{load: load, after: after}
+}
+
+// observe judges the link readings of metrics at the utilization util and
+// returns the verdict, nil while it is unknown. Below the load the last
+// verdict is kept, as the link may be reduced on purpose.
+func (w *linkWatch) observe(now time.Time, util Value, metrics QueryMetrics) *bool {
+	genCurrent, genMax := metrics[pcieGenCurrent], metrics[pcieGenMax]
+	widthCurrent, widthMax := metrics[pcieWidthCurrent], metrics[pcieWidthMax]
+	for _, v := range []Value{genCurrent, genMax, widthCurrent, widthMax, util} {
+		if !v.Valid() {
+			return w.degraded
+		}
+	}
+
+	if util.Num < w.load {
+		w.reducedSince = time.Time{}
+		return w.degraded
+	}
+
+	degraded := false
+	if genCurrent.Num < genMax.Num || widthCurrent.Num < widthMax.Num {
+		if w.reducedSince.IsZero() {
+			w.reducedSince = now
+		}
+		if now.Sub(w.reducedSince) < w.after {
+			return w.degraded
+		}
+		degraded = true
+	} else {
+		w.reducedSince = time.Time{}
+	}
+
+	// A new pointer per change, states sent earlier share the old one.
+	if w.degraded == nil || *w.degraded != degraded {
+		w.degraded = &degraded
+	}
+	return w.degraded
+}
@@ -0,0 +1,54 @@
+package gpuinfo
+
+import (
+	"math"
+	"slices"
+)
+
+// PowerLimitPercentKey is the query payload key of the power draw in percent
+// of the enforced power limit, derived from PowerFields.
+const PowerLimitPercentKey = "power_limit_percent"
+
+// Payload keys of PowerFields used for the power limit percentage.
+const (
+	powerDrawAverage   = "power_draw_average"
+	powerDrawInstant   = "power_draw_instant"
+	enforcedPowerLimit = "enforced_power_limit"
+)
+
+// powerKeys are the query keys powerLimitPercent is derived from.
+var powerKeys = []string{enforcedPowerLimit, powerDrawAverage, powerDrawInstant}
+
+// hasPowerKey reports whether metrics contain one of powerKeys.
+func hasPowerKey(metrics QueryMetrics) bool {
+	return slices.ContainsFunc(powerKeys, func(key string) bool {
+		_, found := metrics[key]
+		return found
+	})
+}
+
+// usesDmonPower reports whether powerLimitPercent of metrics falls back to
+// the power reported by dmon, as no draw was queried.
+func usesDmonPower(metrics QueryMetrics) bool {
+	return metrics[enforcedPowerLimit].Valid() && !metrics[powerDrawAverage].Valid() && !metrics[powerDrawInstant].Valid()
+}
+
+// powerLimitPercent returns the power draw in percent of the enforced limit.
+// The averaged draw is preferred, as the limit is enforced on it, then the
+// instant draw and last the power reported by dmon.
+func powerLimitPercent(metrics QueryMetrics, dmonPwr Value) Value {
+	limit := metrics[enforcedPowerLimit]
+	if !limit.Valid() {
+		return limit
+	}
+	if limit.Num <= 0 {
+		return Value{Status: ValueUnavailable}
+	}
+
+	for _, draw := range []Value{metrics[powerDrawAverage], metrics[powerDrawInstant], dmonPwr} {
+		if draw.Valid() {
+			return NewValue(math.Round(draw.Num/limit.Num*1000) / 10)
+		}
+	}
+	return Value{Status: ValueUnavailable}
+}
@@ -0,0 +1,300 @@
+package gpuinfo
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// QueryModePerGpu runs one query-gpu call per GPU and tick.
+	QueryModePerGpu = "per_gpu"
+	// QueryModeBatched runs one query-gpu call for all GPUs per tick.
+	QueryModeBatched = "batched"
+	// QueryModeStream keeps one supervised query-gpu process with -lms running for all GPUs.
+	QueryModeStream = "stream"
+)
+
+// queryGroup is a set of query-gpu fields polled together. The adaptive
+// group follows the query interval and the activity, the others poll at
+// their own interval, starting right away.
+type queryGroup struct {
+	name     string
+	fields   []QueryField
+	interval time.Duration
+	adaptive bool
+}
+
+// queryGroups splits the query fields into the configured groups and the
+// adaptive group with all remaining fields.
+func (n *NvidiaSmi) queryGroups() []queryGroup {
+	grouped := make(map[string]bool)
+	var groups []queryGroup
+	for _, config := range n.opts.QueryGroups {
+		group := queryGroup{name: config.Name, interval: time.Duration(config.Interval) * time.Second}
+		for _, field := range n.opts.QueryFields {
+			if slices.Contains(config.Properties, field.Property) && !grouped[field.Property] {
+				group.fields = append(group.fields, field)
+				grouped[field.Property] = true
+			}
+		}
+		if len(group.fields) > 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	main := queryGroup{name: "default", adaptive: true}
+	for _, field := range n.opts.QueryFields {
+		if !grouped[field.Property] {
+			main.fields = append(main.fields, field)
+		}
+	}
+	if len(main.fields) > 0 {
+		groups = append([]queryGroup{main}, groups...)
+	}
+	return groups
+}
+
+// slowQueryKeys returns the payload keys of the groups polled less often
+// than the adaptive group at any activity, e.g. the static driver version.
+func (n *NvidiaSmi) slowQueryKeys() []string {
+	// The idle interval only applies with adaptive polling.
+	interval := n.queryInterval(false)
+	if n.opts.AdaptivePolling {
+		interval = max(interval, n.queryInterval(true))
+	}
+	var keys []string
+	for _, group := range n.queryGroups() {
+		if group.adaptive || group.interval <= interval {
+			continue
+		}
+		for _, field := range group.fields {
+			keys = append(keys, field.PayloadKey())
+		}
+	}
+	return keys
+}
+
+// schedule calls poll on the interval of group until ctx is cancelled or
+// poll reports false.
+func (n *NvidiaSmi) schedule(ctx context.Context, group queryGroup, act *activity, poll func() bool) {
+	interval := func(idle bool) time.Duration {
+		if group.adaptive {
+			return n.queryInterval(idle)
+		}
+		return group.interval
+	}
+	if !group.adaptive {
+		act = nil
+	}
+
+	idle, changed := act.state()
+	ticker := time.NewTicker(interval(idle))
+	defer ticker.Stop()
+
+	// Slow groups would otherwise stay empty for a whole interval.
+	if !group.adaptive && !poll() {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+			idle, changed = act.state()
+			ticker.Reset(interval(idle))
+		case <-ticker.C:
+			if !poll() {
+				return
+			}
+		}
+	}
+}
+
+// runQuery polls the fields of group for a single GPU. Failures are passed
+// to report and repeated failures pause polling, see breaker.
+func (n *NvidiaSmi) runQuery(ctx context.Context, gpu GPU, group queryGroup, act *activity, out chan<- QueryMetrics, report reportFunc) {
+	logger := n.logger
+	var br breaker
+
+	n.schedule(ctx, group, act, func() bool {
+		if !br.allow() || len(n.activeGpus([]GPU{gpu})) == 0 {
+			return true
+		}
+		output, err := n.output(
+			ctx,
+			"--query-gpu="+queryProperties(group.fields),
+			"--format=csv,noheader,nounits",
+			"-i",
+			gpu.Uuid,
+		)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			logger.Error("failed to run query-gpu", "gpu_uuid", gpu.Uuid, "group", group.name, "error", err)
+			if backoff := br.failure(); backoff > 0 {
+				logger.Warn("pausing query-gpu after repeated failures", "gpu_uuid", gpu.Uuid, "group", group.name, "backoff", backoff)
+			}
+			report(fmt.Errorf("query-gpu: %w", err), gpu)
+			return true
+		}
+		br.success()
+
+		select {
+		case out <- parseQueryLine(string(output), group.fields):
+			return true
+		case <-ctx.Done():
+			logger.Info("query context cancelled during send, shutting down monitor", "gpu_uuid", gpu.Uuid)
+			return false
+		}
+	})
+}
+
+// runBatchedQuery queries the fields of group for all gpus with a single
+// nvidia-smi call per tick and fans the rows out to the channel of the GPU
+// named in the uuid column. A failed call is repeated per GPU, so a single
+// failing GPU does not cost the readings of the others.
+func (n *NvidiaSmi) runBatchedQuery(ctx context.Context, gpus []GPU, group queryGroup, act *activity, outs map[string]chan QueryMetrics, report reportFunc) {
+	logger := n.logger
+	var br breaker
+
+	query := func(gpus []GPU) ([]byte, error) {
+		return n.output(
+			ctx,
+			"--query-gpu=uuid,"+queryProperties(group.fields),
+			"--format=csv,noheader,nounits",
+			"-i",
+			gpuUuids(gpus),
+		)
+	}
+	send := func(output []byte) bool {
+		scanner := bufio.NewScanner(strings.NewReader(string(output)))
+		for scanner.Scan() {
+			if err := n.sendQueryRow(ctx, scanner.Text(), group.fields, outs); err != nil {
+				logger.Info("query context cancelled during send, shutting down monitor")
+				return false
+			}
+		}
+		return true
+	}
+
+	n.schedule(ctx, group, act, func() bool {
+		active := n.activeGpus(gpus)
+		if !br.allow() || len(active) == 0 {
+			return true
+		}
+		output, err := query(active)
+		if err == nil {
+			br.success()
+			return send(output)
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		if len(active) > 1 {
+			logger.Warn("batched query-gpu failed, querying gpus one by one", "group", group.name, "error", err)
+		}
+
+		failed := 0
+		for _, gpu := range active {
+			if len(active) > 1 {
+				output, err = query([]GPU{gpu})
+				if ctx.Err() != nil {
+					return false
+				}
+			}
+			if err != nil {
+				failed++
+				logger.Error("failed to run batched query-gpu", "gpu_uuid", gpu.Uuid, "group", group.name, "error", err)
+				report(fmt.Errorf("query-gpu: %w", err), gpu)
+				continue
+			}
+			if !send(output) {
+				return false
+			}
+		}
+
+		if failed < len(active) {
+			br.success()
+		} else if backoff := br.failure(); backoff > 0 {
+			logger.Warn("pausing batched query-gpu after repeated failures", "group", group.name, "backoff", backoff)
+		}
+		return true
+	})
+}
+
+// runStreamQuery keeps one supervised nvidia-smi query-gpu process with -lms
+// running for the fields of group and all gpus until ctx is cancelled.
+func (n *NvidiaSmi) runStreamQuery(ctx context.Context, gpus []GPU, group queryGroup, sup *supervisor, act *activity, outs map[string]chan QueryMetrics) {
+	act.run(ctx, func(ctx context.Context, idle bool) {
+		interval := n.queryInterval(idle)
+
+		sup.setStallTimeout(n.queryStallTimeout(interval))
+		sup.run(ctx, func(ctx context.Context, wd *watchdog) error {
+			// Lost GPUs are left out, as a single one fails the process for all.
+			active := n.activeGpus(gpus)
+			if len(active) == 0 {
+				wd.Busy(true)
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			args := []string{
+				"--query-gpu=uuid," + queryProperties(group.fields),
+				"--format=csv,noheader,nounits",
+				"-lms",
+				strconv.FormatInt(interval.Milliseconds(), 10),
+				"-i",
+				gpuUuids(active),
+			}
+			return n.runStream(ctx, "query-gpu", wd, args, func(line string) error {
+				return n.sendQueryRow(ctx, line, group.fields, outs)
+			})
+		})
+	})
+	n.logger.Info("query supervisor finished, shutting down monitor")
+}
+
+// sendQueryRow parses a query-gpu row starting with the uuid column and
+// sends it to the channel of that GPU.
+func (n *NvidiaSmi) sendQueryRow(ctx context.Context, line string, fields []QueryField, outs map[string]chan QueryMetrics) error {
+	uuid, rest, found := strings.Cut(line, ",")
+	if !found {
+		return nil
+	}
+	out, found := outs[strings.TrimSpace(uuid)]
+	if !found {
+		n.logger.Debug("query-gpu row for unknown gpu", "gpu_uuid", uuid)
+		return nil
+	}
+
+	select {
+	case out <- parseQueryLine(rest, fields):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// queryStallTimeout is how long the streaming query may stay silent before it counts as stalled.
+func (n *NvidiaSmi) queryStallTimeout(interval time.Duration) time.Duration {
+	return time.Duration(n.opts.DmonStallFactor) * interval
+}
+
+// parseQueryLine maps the values of a query-gpu row to the payload keys of fields.
+func parseQueryLine(line string, fields []QueryField) QueryMetrics {
+	parts := strings.Split(strings.TrimSpace(line), ",")
+	if len(parts) != len(fields) {
+		return QueryMetrics{}
+	}
+
+	metrics := make(QueryMetrics, len(fields))
+	for i, field := range fields {
+		metrics[field.PayloadKey()] = field.parse(parts[i])
+	}
+	return metrics
+}
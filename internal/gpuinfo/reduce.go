@@ -0,0 +1,118 @@
+package gpuinfo
+
+import (
+	"maps"
+	"strings"
+)
+
+// Reductions of the samples collected between two publishes.
+const (
+	ReductionLast = "last"
+	ReductionAvg  = "avg"
+	ReductionMax  = "max"
+)
+
+// Metrics returns the dmon metrics keyed by "dmon.<column>".
+func (m DmonMetrics) Metrics() map[string]Value {
+	metrics := make(map[string]Value, len(dmonFields))
+	for column, field := range dmonFields {
+		metrics["dmon."+column] = *field(&m)
+	}
+	return metrics
+}
+
+// Metrics returns the query metrics keyed by "query.<key>".
+func (m QueryMetrics) Metrics() map[string]Value {
+	metrics := make(map[string]Value, len(m))
+	for key, value := range m {
+		metrics["query."+key] = value
+	}
+	return metrics
+}
+
+// Metrics returns all dmon and query metrics of the state keyed by their
+// path in the state payload, e.g. "dmon.pwr" or "query.utilgpu".
+func (s GpuState) Metrics() map[string]Value {
+	metrics := s.DmonMetrics.Metrics()
+	maps.Copy(metrics, s.QueryMetrics.Metrics())
+	return metrics
+}
+
+// WithMetrics returns a copy of s with the given metrics replaced.
+// Names follow Metrics, unknown names are ignored.
+func (s GpuState) WithMetrics(metrics map[string]Value) GpuState {
+	// The query map may be shared with states sent earlier, so copy it first.
+	s.QueryMetrics = maps.Clone(s.QueryMetrics)
+	for name, value := range metrics {
+		source, key, _ := strings.Cut(name, ".")
+		switch source {
+		case "dmon":
+			if field, found := dmonFields[key]; found {
+				*field(&s.DmonMetrics) = value
+			}
+		case "query":
+			if _, found := s.QueryMetrics[key]; found {
+				s.QueryMetrics[key] = value
+			}
+		}
+	}
+	return s
+}
+
+// reducer aggregates the numeric samples of one GPU between two publishes.
+type reducer struct {
+	mode   string
+	sums   map[string]float64
+	counts map[string]int
+	maxes  map[string]float64
+}
+
+func newReducer(mode string) *reducer {
+	r := &reducer{mode: mode}
+	r.reset()
+	return r
+}
+
+func (r *reducer) reset() {
+	r.sums = make(map[string]float64)
+	r.counts = make(map[string]int)
+	r.maxes = make(map[string]float64)
+}
+
+// add records the valid numeric values of metrics.
+func (r *reducer) add(metrics map[string]Value) {
+	if r.mode == ReductionLast {
+		return
+	}
+	for name, value := range metrics {
+		// Text and boolean values always keep their last reading.
+		if !value.Valid() || value.Text != "" || value.Bool {
+			continue
+		}
+		if r.counts[name] == 0 || value.Num > r.maxes[name] {
+			r.maxes[name] = value.Num
+		}
+		r.sums[name] += value.Num
+		r.counts[name]++
+	}
+}
+
+// apply returns state with the metrics replaced by their reduction
+// and starts a new interval.
+func (r *reducer) apply(state GpuState) GpuState {
+	if r.mode == ReductionLast || len(r.counts) == 0 {
+		return state
+	}
+
+	reduced := make(map[string]Value, len(r.counts))
+	for name, count := range r.counts {
+		switch r.mode {
+		case ReductionAvg:
+			reduced[name] = NewValue(r.sums[name] / float64(count))
+		case ReductionMax:
+			reduced[name] = NewValue(r.maxes[name])
+		}
+	}
+	r.reset()
+	return state.WithMetrics(reduced)
+}
@@ -0,0 +1,53 @@
+package gpuinfo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"time"
+)
+
+const waitDelay = 2 * time.Second
+
+// Runner creates the external commands a collector executes.
+// It allows replacing nvidia-smi with a fake that replays recorded output.
+type Runner interface {
+	Command(ctx context.Context, name string, args ...string) Cmd
+}
+
+// Cmd is the subset of *exec.Cmd used by the collectors.
+type Cmd interface {
+	Output() ([]byte, error)
+	StdoutPipe() (io.ReadCloser, error)
+	StderrPipe() (io.ReadCloser, error)
+	Start() error
+	Wait() error
+}
+
+// ExitError is the error of a command that exited with a non-zero code.
+// *exec.ExitError implements it, fakes of Cmd return their own.
+type ExitError interface {
+	error
+	ExitCode() int
+}
+
+// exitCode returns the exit code of the command that failed with err, -1 if
+// err is not an ExitError.
+func exitCode(err error) int {
+	var exitErr ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// ExecRunner runs commands via os/exec.
+type ExecRunner struct{}
+
+func (ExecRunner) Command(ctx context.Context, name string, args ...string) Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Don't wait forever for children that keep the output open after a kill.
+	cmd.WaitDelay = waitDelay
+	return cmd
+}
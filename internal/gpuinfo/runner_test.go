@@ -0,0 +1,126 @@
+package gpuinfo
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// replay is the recorded answer of nvidia-smi to the calls it matches.
+type replay struct {
+	// match has to be contained in the space-joined arguments of a call.
+	match  string
+	stdout string
+	stderr string
+	code   int
+	// stream keeps stdout open until the call is cancelled, like dmon.
+	stream bool
+}
+
+// replayRunner answers each call with the first replay it matches. Calls
+// without a replay fail with exit code 2, as nvidia-smi does for unknown
+// arguments.
+type replayRunner struct {
+	replays []replay
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *replayRunner) Command(ctx context.Context, name string, args ...string) Cmd {
+	call := strings.Join(args, " ")
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	r.mu.Unlock()
+
+	for _, replay := range r.replays {
+		if strings.Contains(call, replay.match) {
+			return &replayCmd{ctx: ctx, replay: replay}
+		}
+	}
+	return &replayCmd{ctx: ctx, replay: replay{stdout: "Invalid combination of input arguments.", code: 2}}
+}
+
+// called reports whether a call had exactly the given arguments.
+func (r *replayRunner) called(args string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, call := range r.calls {
+		if call == args {
+			return true
+		}
+	}
+	return false
+}
+
+type replayCmd struct {
+	ctx    context.Context
+	replay replay
+	stdout *io.PipeWriter
+}
+
+func (c *replayCmd) Output() ([]byte, error) {
+	return []byte(c.replay.stdout), c.exitErr()
+}
+
+func (c *replayCmd) StdoutPipe() (io.ReadCloser, error) {
+	reader, writer := io.Pipe()
+	c.stdout = writer
+	return reader, nil
+}
+
+func (c *replayCmd) StderrPipe() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(c.replay.stderr)), nil
+}
+
+func (c *replayCmd) Start() error {
+	go func() {
+		_, _ = io.WriteString(c.stdout, c.replay.stdout)
+		if c.replay.stream {
+			<-c.ctx.Done()
+		}
+		c.stdout.Close()
+	}()
+	return nil
+}
+
+func (c *replayCmd) Wait() error {
+	if c.replay.stream {
+		<-c.ctx.Done()
+		return c.ctx.Err()
+	}
+	return c.exitErr()
+}
+
+func (c *replayCmd) exitErr() error {
+	if c.replay.code == 0 {
+		return nil
+	}
+	return replayExitError(c.replay.code)
+}
+
+// replayExitError is the ExitError of a replayed call.
+type replayExitError int
+
+func (e replayExitError) Error() string {
+	return "exit status " + strconv.Itoa(int(e))
+}
+
+func (e replayExitError) ExitCode() int {
+	return int(e)
+}
+
+// fixture returns the content of a file in testdata.
+func fixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,147 @@
+package gpuinfo
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Power states of a GPU as seen by PCI runtime power management.
+const (
+	PowerStateActive    = "active"
+	PowerStateSuspended = "suspended"
+)
+
+// powerStateInterval is how often the merge loop re-reads the runtime status.
+const powerStateInterval = time.Second
+
+// normalizeBusId converts the pci.bus_id of nvidia-smi, e.g. "00000000:01:00.0",
+// to the sysfs form "0000:01:00.0".
+func normalizeBusId(id string) string {
+	id = strings.ToLower(strings.TrimSpace(id))
+	domain, rest, found := strings.Cut(id, ":")
+	if !found {
+		return id
+	}
+	if len(domain) > 4 {
+		domain = domain[len(domain)-4:]
+	}
+	return domain + ":" + rest
+}
+
+// powerState reads the runtime PM status of gpu from sysfs. Reading it does
+// not wake the GPU. GPUs without runtime PM count as active.
+func (n *NvidiaSmi) powerState(gpu GPU) string {
+	if gpu.PciBusId == "" {
+		return PowerStateActive
+	}
+	path := filepath.Join(n.opts.SysfsRoot, "bus", "pci", "devices", gpu.PciBusId, "power", "runtime_status")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PowerStateActive
+	}
+
+	switch strings.TrimSpace(string(data)) {
+	case "suspended", "suspending":
+		return PowerStateSuspended
+	}
+	return PowerStateActive
+}
+
+// activeGpus returns the gpus that may be polled without waking them,
+// leaving out GPUs reported lost.
+func (n *NvidiaSmi) activeGpus(gpus []GPU) []GPU {
+	active := make([]GPU, 0, len(gpus))
+	for _, gpu := range gpus {
+		if _, lost := n.lost.Load(gpu.Uuid); lost {
+			continue
+		}
+		if n.opts.RuntimePM && n.powerState(gpu) != PowerStateActive {
+			continue
+		}
+		active = append(active, gpu)
+	}
+	return active
+}
+
+// SuspendedGpus returns the gpus suspended by runtime PM. Without RuntimePM
+// no GPU counts as suspended.
+func (n *NvidiaSmi) SuspendedGpus(gpus []GPU) []GPU {
+	var suspended []GPU
+	if !n.opts.RuntimePM {
+		return suspended
+	}
+	for _, gpu := range gpus {
+		if n.powerState(gpu) == PowerStateSuspended {
+			suspended = append(suspended, gpu)
+		}
+	}
+	return suspended
+}
+
+// runPolledDmon takes a single dmon sample of the active gpus per interval.
+// Unlike the long-running dmon process it releases the GPUs between two
+// samples, so they can enter runtime suspend.
+func (n *NvidiaSmi) runPolledDmon(ctx context.Context, gpus []GPU, act *activity, outs map[int]chan DmonMetrics, report reportFunc) {
+	logger := n.logger
+	idle, changed := act.state()
+	ticker := time.NewTicker(time.Duration(n.dmonInterval(idle)) * time.Second)
+	defer ticker.Stop()
+	var br breaker
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+			idle, changed = act.state()
+			ticker.Reset(time.Duration(n.dmonInterval(idle)) * time.Second)
+		case <-ticker.C:
+			active := n.activeGpus(gpus)
+			if len(active) == 0 || !br.allow() {
+				continue
+			}
+
+			args := []string{"dmon", "-c", "1", "-s", n.opts.DmonGroups, "--format", "csv", "-i", gpuUuids(active)}
+			if n.opts.DmonTimestamps {
+				args = append(args, "-o", "DT")
+			}
+			output, err := n.output(ctx, args...)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Error("failed to run dmon", "error", err)
+				if backoff := br.failure(); backoff > 0 {
+					logger.Warn("pausing dmon after repeated failures", "backoff", backoff)
+				}
+				report(fmt.Errorf("dmon: %w", err))
+				continue
+			}
+			br.success()
+
+			parser := newDmonParser(logger)
+			scanner := bufio.NewScanner(strings.NewReader(string(output)))
+			for scanner.Scan() {
+				metrics, ok := parser.parseLine(scanner.Text())
+				if !ok {
+					continue
+				}
+				out, found := outs[metrics.Id]
+				if !found {
+					logger.Debug("dmon line for unknown gpu index", "id", metrics.Id)
+					continue
+				}
+				select {
+				case out <- metrics:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
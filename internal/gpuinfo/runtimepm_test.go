@@ -0,0 +1,231 @@
+package gpuinfo
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSysfs creates a sysfs tree below a temporary root with the runtime PM
+// status of each bus id, and returns the root.
+func fakeSysfs(t *testing.T, statuses map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for busId, status := range statuses {
+		dir := filepath.Join(root, "bus", "pci", "devices", busId, "power")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "runtime_status"), []byte(status+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestNormalizeBusId(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"00000000:01:00.0", "0000:01:00.0"},
+		{"0000:0A:00.0", "0000:0a:00.0"},
+		{" 00000001:C1:00.0 ", "0001:c1:00.0"},
+		{"01:00.0", "01:00.0"},
+	}
+	for _, tt := range tests {
+		if got := normalizeBusId(tt.id); got != tt.want {
+			t.Errorf("normalizeBusId(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestPowerState(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"0000:01:00.0": "active",
+		"0000:02:00.0": "suspended",
+		"0000:03:00.0": "suspending",
+		"0000:04:00.0": "resuming",
+	})
+	n := NewNvidiaSmi(nil, slog.New(slog.DiscardHandler), Options{RuntimePM: true, SysfsRoot: root})
+
+	tests := []struct {
+		busId string
+		want  string
+	}{
+		{"0000:01:00.0", PowerStateActive},
+		{"0000:02:00.0", PowerStateSuspended},
+		{"0000:03:00.0", PowerStateSuspended},
+		{"0000:04:00.0", PowerStateActive},
+		// Without runtime PM support the GPU counts as active.
+		{"0000:05:00.0", PowerStateActive},
+		{"", PowerStateActive},
+	}
+	for _, tt := range tests {
+		if got := n.powerState(GPU{PciBusId: tt.busId}); got != tt.want {
+			t.Errorf("powerState(%q) = %q, want %q", tt.busId, got, tt.want)
+		}
+	}
+}
+
+func TestActiveGpus(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{"0000:01:00.0": "suspended", "0000:02:00.0": "active"})
+	n := NewNvidiaSmi(nil, slog.New(slog.DiscardHandler), Options{RuntimePM: true, SysfsRoot: root})
+
+	if active := n.activeGpus(testGpus); len(active) != 1 || active[0].Uuid != testGpus[1].Uuid {
+		t.Errorf("activeGpus = %v, want only the active gpu", active)
+	}
+	n.lost.Store(testGpus[1].Uuid, true)
+	if active := n.activeGpus(testGpus); len(active) != 0 {
+		t.Errorf("activeGpus = %v, want none once the active gpu is lost", active)
+	}
+}
+
+func TestSuspendedGpus(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{"0000:01:00.0": "suspended", "0000:02:00.0": "active"})
+	n := NewNvidiaSmi(nil, slog.New(slog.DiscardHandler), Options{RuntimePM: true, SysfsRoot: root})
+	if suspended := n.SuspendedGpus(testGpus); len(suspended) != 1 || suspended[0].Uuid != testGpus[0].Uuid {
+		t.Errorf("SuspendedGpus = %v, want only the suspended gpu", suspended)
+	}
+
+	// Without runtime PM nvidia-smi is called anyway.
+	n = NewNvidiaSmi(nil, slog.New(slog.DiscardHandler), Options{SysfsRoot: root})
+	if suspended := n.SuspendedGpus(testGpus); len(suspended) != 0 {
+		t.Errorf("SuspendedGpus = %v without runtime pm, want none", suspended)
+	}
+}
+
+func TestSlowQueryKeys(t *testing.T) {
+	groups := []QueryGroup{
+		{Name: "static", Interval: 3600, Properties: []string{"driver_version"}},
+		{Name: "state", Interval: 30, Properties: []string{"pstate"}},
+	}
+	tests := []struct {
+		name     string
+		adaptive bool
+		want     []string
+	}{
+		{"fixed interval", false, []string{"drivver", "pstat"}},
+		// Polled every 60 seconds while idle, the state group is not slower.
+		{"adaptive polling", true, []string{"drivver"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNvidiaSmi(nil, slog.New(slog.DiscardHandler), Options{
+				QueryInterval:     10 * time.Second,
+				IdleQueryInterval: 60 * time.Second,
+				AdaptivePolling:   tt.adaptive,
+				QueryGroups:       groups,
+			})
+			if keys := n.slowQueryKeys(); !slices.Equal(keys, tt.want) {
+				t.Errorf("slowQueryKeys() = %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestCombinedMonitorRuntimePM(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{"0000:01:00.0": "active", "0000:02:00.0": "suspended"})
+	// dmon prints the header, the units and the line of the only active GPU.
+	dmon := strings.Join(strings.SplitAfter(fixture(t, "dmon.csv"), "\n")[:3], "")
+	runner := &replayRunner{replays: []replay{
+		{match: "dmon -c 1", stdout: dmon},
+		{match: "-i " + testGpus[0].Uuid, stdout: "35, 1024, 23552, 550.54.15, 30, P2\n"},
+	}}
+	n := NewNvidiaSmi(runner, slog.New(slog.DiscardHandler), Options{
+		DmonInterval:    1,
+		DmonStallFactor: 5,
+		QueryInterval:   20 * time.Millisecond,
+		RuntimePM:       true,
+		SysfsRoot:       root,
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	states, err := n.CombinedMonitor(ctx, testGpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The suspended GPU has no updates, its state is repeated anyway.
+	suspended := 0
+	last := collectStates(t, states, func(state GpuState) bool {
+		if state.Gpu.Uuid == testGpus[1].Uuid {
+			suspended++
+			return suspended > 1
+		}
+		return state.DmonMetrics.Pwr.Valid() && state.QueryMetrics["utilgpu"].Valid()
+	})
+	if state := last[testGpus[1].Uuid]; state.PowerState != PowerStateSuspended || state.DmonMetrics.Pwr.Valid() {
+		t.Errorf("suspended gpu: power state %q with pwr %+v, want suspended without metrics", state.PowerState, state.DmonMetrics.Pwr)
+	}
+	if state := last[testGpus[0].Uuid]; state.PowerState != PowerStateActive || state.DmonMetrics.Pwr.Num != 72 {
+		t.Errorf("active gpu: power state %q with pwr %+v, want active with 72", state.PowerState, state.DmonMetrics.Pwr)
+	}
+
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	for _, call := range runner.calls {
+		if strings.Contains(call, testGpus[1].Uuid) {
+			t.Errorf("suspended gpu was woken by %q", call)
+		}
+	}
+}
+
+func TestCombinedMonitorSuspendBetweenPublishTicks(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{"0000:01:00.0": "active"})
+	runner := &replayRunner{replays: []replay{
+		{match: "dmon -c 1", stdout: strings.Join(strings.SplitAfter(fixture(t, "dmon.csv"), "\n")[:3], "")},
+		{match: "-i " + testGpus[0].Uuid, stdout: "35, 1024, 23552, 550.54.15, 30, P2\n"},
+	}}
+	n := NewNvidiaSmi(runner, slog.New(slog.DiscardHandler), Options{
+		DmonInterval:    1,
+		DmonStallFactor: 5,
+		QueryInterval:   20 * time.Millisecond,
+		PublishInterval: 2500 * time.Millisecond,
+		Reduction:       ReductionAvg,
+		StatsWindow:     time.Minute,
+		RuntimePM:       true,
+		SysfsRoot:       root,
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	states, err := n.CombinedMonitor(ctx, testGpus[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The GPU suspends after the first dmon sample, before the first tick.
+	deadline := time.Now().Add(5 * time.Second)
+	for !runner.called("dmon -c 1 -s " + DefaultDmonGroups + " --format csv -i " + testGpus[0].Uuid) {
+		if time.Now().After(deadline) {
+			t.Fatal("dmon was not sampled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	status := filepath.Join(root, "bus", "pci", "devices", "0000:01:00.0", "power", "runtime_status")
+	if err := os.WriteFile(status, []byte("suspended\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case state := <-states:
+		if state.PowerState != PowerStateSuspended {
+			t.Fatalf("power state = %q, want suspended", state.PowerState)
+		}
+		if state.DmonMetrics.Pwr.Valid() || state.QueryMetrics["utilgpu"].Valid() {
+			t.Errorf("pwr %+v and utilgpu %+v, want them missing", state.DmonMetrics.Pwr, state.QueryMetrics["utilgpu"])
+		}
+		if len(state.Stats) != 0 {
+			t.Errorf("stats = %v, want none", state.Stats)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state published")
+	}
+}
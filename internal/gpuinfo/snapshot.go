@@ -0,0 +1,404 @@
+package gpuinfo
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Snapshot is the per-GPU subset of "nvidia-smi -q -x" that is not
+// available via dmon or query-gpu.
+type Snapshot struct {
+	ProductName       string           `json:"product_name"`
+	Serial            Value            `json:"serial"`
+	VbiosVersion      Value            `json:"vbios_version"`
+	DriverVersion     Value            `json:"driver_version"`
+	PciBusId          string           `json:"pci_bus_id"`
+	Pcie              PcieLink         `json:"pcie"`
+	ClockEventReasons map[string]Value `json:"clock_event_reasons,omitempty"`
+	Ecc               EccErrors        `json:"ecc"`
+	RetiredPages      RetiredPages     `json:"retired_pages"`
+	RemappedRows      RemappedRows     `json:"remapped_rows"`
+	Temperature       Temperatures     `json:"temperature"`
+	Power             PowerReadings    `json:"power"`
+}
+
+type PcieLink struct {
+	GenCurrent    Value `json:"gen_current"`
+	GenMax        Value `json:"gen_max"`
+	WidthCurrent  Value `json:"width_current"`
+	WidthMax      Value `json:"width_max"`
+	ReplayCounter Value `json:"replay_counter"`
+}
+
+type EccErrors struct {
+	Mode                 Value `json:"mode"`
+	VolatileCorrected    Value `json:"volatile_corrected"`
+	VolatileUncorrected  Value `json:"volatile_uncorrected"`
+	AggregateCorrected   Value `json:"aggregate_corrected"`
+	AggregateUncorrected Value `json:"aggregate_uncorrected"`
+}
+
+type RetiredPages struct {
+	SingleBit Value `json:"single_bit"`
+	DoubleBit Value `json:"double_bit"`
+	Pending   Value `json:"pending"`
+}
+
+type RemappedRows struct {
+	Correctable   Value `json:"correctable"`
+	Uncorrectable Value `json:"uncorrectable"`
+	Pending       Value `json:"pending"`
+	Failure       Value `json:"failure"`
+	HistogramMax  Value `json:"histogram_max"`
+	HistogramHigh Value `json:"histogram_high"`
+	HistogramPart Value `json:"histogram_partial"`
+	HistogramLow  Value `json:"histogram_low"`
+	HistogramNone Value `json:"histogram_none"`
+}
+
+type Temperatures struct {
+	Gpu          Value `json:"gpu"`
+	Memory       Value `json:"memory"`
+	Shutdown     Value `json:"shutdown"`
+	Slowdown     Value `json:"slowdown"`
+	MaxOperating Value `json:"max_operating"`
+	MaxMemory    Value `json:"max_memory"`
+	Target       Value `json:"target"`
+}
+
+type PowerReadings struct {
+	Draw           Value `json:"draw"`
+	Limit          Value `json:"limit"`
+	RequestedLimit Value `json:"requested_limit"`
+	DefaultLimit   Value `json:"default_limit"`
+	MinLimit       Value `json:"min_limit"`
+	MaxLimit       Value `json:"max_limit"`
+}
+
+// runSnapshot polls "nvidia-smi -q -x" for gpus and sends the snapshot
+// of each GPU to its channel, keyed by UUID. Failures are passed to report.
+func (n *NvidiaSmi) runSnapshot(ctx context.Context, gpus []GPU, outs map[string]chan Snapshot, report reportFunc) {
+	logger := n.logger
+	ticker := time.NewTicker(n.opts.SnapshotInterval)
+	defer ticker.Stop()
+	var br breaker
+
+	// fetch runs one "-q -x" call for targets, all GPUs if empty, and
+	// reports false once ctx is cancelled.
+	fetch := func(targets []GPU, args ...string) bool {
+		output, err := n.output(ctx, args...)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			logger.Error("failed to run nvidia-smi -q -x", "error", err)
+			if backoff := br.failure(); backoff > 0 {
+				logger.Warn("pausing snapshots after repeated failures", "backoff", backoff)
+			}
+			report(fmt.Errorf("snapshot: %w", err), targets...)
+			return true
+		}
+		br.success()
+
+		snapshots, err := parseSnapshots(output)
+		if err != nil {
+			logger.Error("failed to parse nvidia-smi xml", "error", err)
+			return true
+		}
+
+		for uuid, snapshot := range snapshots {
+			out, found := outs[uuid]
+			if !found {
+				continue
+			}
+			select {
+			case out <- snapshot:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		return true
+	}
+
+	// poll fetches the snapshots of all GPUs, or one by one for the active
+	// GPUs if runtime PM is enabled, as -q would wake suspended ones, or a
+	// GPU was lost, as it fails the call for all.
+	poll := func() bool {
+		if !br.allow() {
+			return true
+		}
+		active := n.activeGpus(gpus)
+		if !n.opts.RuntimePM && len(active) == len(gpus) {
+			return fetch(nil, "-q", "-x")
+		}
+		for _, gpu := range active {
+			if !fetch([]GPU{gpu}, "-q", "-x", "-i", gpu.Uuid) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// The snapshot is mostly static, so fetch it right away.
+	if !poll() {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !poll() {
+				return
+			}
+		}
+	}
+}
+
+// parseSnapshots parses the output of "nvidia-smi -q -x" into snapshots keyed by GPU UUID.
+func parseSnapshots(data []byte) (map[string]Snapshot, error) {
+	var log xmlLog
+	if err := xml.Unmarshal(data, &log); err != nil {
+		return nil, fmt.Errorf("failed to decode xml: %w", err)
+	}
+
+	snapshots := make(map[string]Snapshot, len(log.Gpus))
+	for _, gpu := range log.Gpus {
+		snapshots[strings.TrimSpace(gpu.Uuid)] = gpu.snapshot(log.DriverVersion)
+	}
+	return snapshots, nil
+}
+
+// The xml* types mirror the nvidia-smi XML layout. Element names differ
+// between driver generations, both variants are decoded where needed.
+type xmlLog struct {
+	DriverVersion string   `xml:"driver_version"`
+	Gpus          []xmlGpu `xml:"gpu"`
+}
+
+type xmlGpu struct {
+	ProductName           string       `xml:"product_name"`
+	Serial                string       `xml:"serial"`
+	Uuid                  string       `xml:"uuid"`
+	VbiosVersion          string       `xml:"vbios_version"`
+	Pci                   xmlPci       `xml:"pci"`
+	ClocksEventReasons    xmlAnyList   `xml:"clocks_event_reasons"`
+	ClocksThrottleReasons xmlAnyList   `xml:"clocks_throttle_reasons"`
+	EccMode               xmlEccMode   `xml:"ecc_mode"`
+	EccErrors             xmlEccErrors `xml:"ecc_errors"`
+	RetiredPages          xmlRetired   `xml:"retired_pages"`
+	RemappedRows          xmlRemapped  `xml:"remapped_rows"`
+	Temperature           xmlTemp      `xml:"temperature"`
+	PowerReadings         xmlPower     `xml:"power_readings"`
+	GpuPowerReadings      xmlPower     `xml:"gpu_power_readings"`
+}
+
+type xmlPci struct {
+	BusId    string `xml:"pci_bus_id"`
+	LinkInfo struct {
+		PcieGen struct {
+			Max     string `xml:"max_link_gen"`
+			Current string `xml:"current_link_gen"`
+		} `xml:"pcie_gen"`
+		LinkWidths struct {
+			Max     string `xml:"max_link_width"`
+			Current string `xml:"current_link_width"`
+		} `xml:"link_widths"`
+	} `xml:"pci_gpu_link_info"`
+	ReplayCounter string `xml:"replay_counter"`
+}
+
+type xmlAnyList struct {
+	Items []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+type xmlEccMode struct {
+	Current string `xml:"current_ecc"`
+}
+
+type xmlEccErrors struct {
+	Volatile  xmlEccCounts `xml:"volatile"`
+	Aggregate xmlEccCounts `xml:"aggregate"`
+}
+
+type xmlEccCounts struct {
+	SramCorrectable   string `xml:"sram_correctable"`
+	SramUncorrectable string `xml:"sram_uncorrectable"`
+	DramCorrectable   string `xml:"dram_correctable"`
+	DramUncorrectable string `xml:"dram_uncorrectable"`
+	SingleBitTotal    string `xml:"single_bit>total"`
+	DoubleBitTotal    string `xml:"double_bit>total"`
+}
+
+type xmlRetired struct {
+	SingleBit        string `xml:"multiple_single_bit_retirement>retired_count"`
+	DoubleBit        string `xml:"double_bit_retirement>retired_count"`
+	PendingBlacklist string `xml:"pending_blacklist"`
+	PendingRetire    string `xml:"pending_retirement"`
+}
+
+type xmlRemapped struct {
+	Correctable   string `xml:"remapped_row_corr"`
+	Uncorrectable string `xml:"remapped_row_unc"`
+	Pending       string `xml:"remapped_row_pending"`
+	Failure       string `xml:"remapped_row_failure"`
+	Histogram     struct {
+		Max     string `xml:"row_remapper_histogram_max"`
+		High    string `xml:"row_remapper_histogram_high"`
+		Partial string `xml:"row_remapper_histogram_partial"`
+		Low     string `xml:"row_remapper_histogram_low"`
+		None    string `xml:"row_remapper_histogram_none"`
+	} `xml:"row_remapper_histogram"`
+}
+
+type xmlTemp struct {
+	Gpu          string `xml:"gpu_temp"`
+	Memory       string `xml:"memory_temp"`
+	Shutdown     string `xml:"gpu_temp_max_threshold"`
+	Slowdown     string `xml:"gpu_temp_slow_threshold"`
+	MaxOperating string `xml:"gpu_temp_max_gpu_threshold"`
+	MaxMemory    string `xml:"gpu_temp_max_mem_threshold"`
+	Target       string `xml:"gpu_target_temperature"`
+}
+
+type xmlPower struct {
+	PowerDraw          string `xml:"power_draw"`
+	AveragePowerDraw   string `xml:"average_power_draw"`
+	PowerLimit         string `xml:"power_limit"`
+	EnforcedPowerLimit string `xml:"enforced_power_limit"`
+	CurrentPowerLimit  string `xml:"current_power_limit"`
+	RequestedLimit     string `xml:"requested_power_limit"`
+	DefaultLimit       string `xml:"default_power_limit"`
+	MinLimit           string `xml:"min_power_limit"`
+	MaxLimit           string `xml:"max_power_limit"`
+}
+
+func (g xmlGpu) snapshot(driverVersion string) Snapshot {
+	power := g.GpuPowerReadings
+	if power == (xmlPower{}) {
+		power = g.PowerReadings
+	}
+	reasons := g.ClocksEventReasons
+	prefix := "clocks_event_reason_"
+	if len(reasons.Items) == 0 {
+		reasons = g.ClocksThrottleReasons
+		prefix = "clocks_throttle_reason_"
+	}
+
+	snapshot := Snapshot{
+		ProductName:   strings.TrimSpace(g.ProductName),
+		Serial:        parseText(g.Serial),
+		VbiosVersion:  parseText(g.VbiosVersion),
+		DriverVersion: parseText(driverVersion),
+		PciBusId:      strings.TrimSpace(g.Pci.BusId),
+		Pcie: PcieLink{
+			GenCurrent:    parseXMLValue(g.Pci.LinkInfo.PcieGen.Current),
+			GenMax:        parseXMLValue(g.Pci.LinkInfo.PcieGen.Max),
+			WidthCurrent:  parseXMLValue(g.Pci.LinkInfo.LinkWidths.Current),
+			WidthMax:      parseXMLValue(g.Pci.LinkInfo.LinkWidths.Max),
+			ReplayCounter: parseXMLValue(g.Pci.ReplayCounter),
+		},
+		Ecc: EccErrors{
+			Mode:                 parseText(g.EccMode.Current),
+			VolatileCorrected:    g.EccErrors.Volatile.corrected(),
+			VolatileUncorrected:  g.EccErrors.Volatile.uncorrected(),
+			AggregateCorrected:   g.EccErrors.Aggregate.corrected(),
+			AggregateUncorrected: g.EccErrors.Aggregate.uncorrected(),
+		},
+		RetiredPages: RetiredPages{
+			SingleBit: parseXMLValue(g.RetiredPages.SingleBit),
+			DoubleBit: parseXMLValue(g.RetiredPages.DoubleBit),
+			Pending:   parseText(firstNonEmpty(g.RetiredPages.PendingRetire, g.RetiredPages.PendingBlacklist)),
+		},
+		RemappedRows: RemappedRows{
+			Correctable:   parseXMLValue(g.RemappedRows.Correctable),
+			Uncorrectable: parseXMLValue(g.RemappedRows.Uncorrectable),
+			Pending:       parseText(g.RemappedRows.Pending),
+			Failure:       parseText(g.RemappedRows.Failure),
+			HistogramMax:  parseXMLValue(g.RemappedRows.Histogram.Max),
+			HistogramHigh: parseXMLValue(g.RemappedRows.Histogram.High),
+			HistogramPart: parseXMLValue(g.RemappedRows.Histogram.Partial),
+			HistogramLow:  parseXMLValue(g.RemappedRows.Histogram.Low),
+			HistogramNone: parseXMLValue(g.RemappedRows.Histogram.None),
+		},
+		Temperature: Temperatures{
+			Gpu:          parseXMLValue(g.Temperature.Gpu),
+			Memory:       parseXMLValue(g.Temperature.Memory),
+			Shutdown:     parseXMLValue(g.Temperature.Shutdown),
+			Slowdown:     parseXMLValue(g.Temperature.Slowdown),
+			MaxOperating: parseXMLValue(g.Temperature.MaxOperating),
+			MaxMemory:    parseXMLValue(g.Temperature.MaxMemory),
+			Target:       parseXMLValue(g.Temperature.Target),
+		},
+		Power: PowerReadings{
+			Draw:           parseXMLValue(firstNonEmpty(power.AveragePowerDraw, power.PowerDraw)),
+			Limit:          parseXMLValue(firstNonEmpty(power.CurrentPowerLimit, power.EnforcedPowerLimit)),
+			RequestedLimit: parseXMLValue(firstNonEmpty(power.RequestedLimit, power.PowerLimit)),
+			DefaultLimit:   parseXMLValue(power.DefaultLimit),
+			MinLimit:       parseXMLValue(power.MinLimit),
+			MaxLimit:       parseXMLValue(power.MaxLimit),
+		},
+	}
+
+	if len(reasons.Items) > 0 {
+		snapshot.ClockEventReasons = make(map[string]Value, len(reasons.Items))
+		for _, item := range reasons.Items {
+			snapshot.ClockEventReasons[strings.TrimPrefix(item.XMLName.Local, prefix)] = parseText(item.Value)
+		}
+	}
+	return snapshot
+}
+
+func (c xmlEccCounts) corrected() Value {
+	if c.SingleBitTotal != "" {
+		return parseXMLValue(c.SingleBitTotal)
+	}
+	return sumValues(parseXMLValue(c.SramCorrectable), parseXMLValue(c.DramCorrectable))
+}
+
+func (c xmlEccCounts) uncorrected() Value {
+	if c.DoubleBitTotal != "" {
+		return parseXMLValue(c.DoubleBitTotal)
+	}
+	return sumValues(parseXMLValue(c.SramUncorrectable), parseXMLValue(c.DramUncorrectable))
+}
+
+// sumValues adds up the valid values and is unavailable if none is valid.
+func sumValues(values ...Value) Value {
+	var sum Value
+	for _, v := range values {
+		if !v.Valid() {
+			continue
+		}
+		sum = NewValue(sum.Num + v.Num)
+	}
+	return sum
+}
+
+// parseXMLValue parses a numeric XML value followed by an optional unit,
+// e.g. "98 C", "350.00 W", "16x" or "640 bank(s)".
+func parseXMLValue(s string) Value {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Value{}
+	}
+	if missing, ok := missingValue(strings.TrimSpace(s)); ok {
+		return missing
+	}
+	return parseValue(strings.TrimSuffix(fields[0], "x"))
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+package gpuinfo
+
+import "testing"
+
+func TestParseSnapshots(t *testing.T) {
+	unavailable := Value{Status: ValueUnavailable}
+	tests := []struct {
+		name     string
+		fixture  string
+		uuid     string
+		product  string
+		driver   string
+		pcie     PcieLink
+		ecc      EccErrors
+		retired  RetiredPages
+		power    PowerReadings
+		memTemp  Value
+		swPowCap Value
+	}{
+		{
+			name:    "r550 with ecc",
+			fixture: "snapshot-r550.xml",
+			uuid:    testGpus[0].Uuid,
+			product: "NVIDIA RTX A6000",
+			driver:  "550.54.15",
+			pcie:    PcieLink{GenCurrent: NewValue(4), GenMax: NewValue(4), WidthCurrent: NewValue(16), WidthMax: NewValue(16), ReplayCounter: NewValue(0)},
+			ecc: EccErrors{
+				Mode:                 parseText("Enabled"),
+				VolatileCorrected:    NewValue(3),
+				VolatileUncorrected:  NewValue(0),
+				AggregateCorrected:   NewValue(14),
+				AggregateUncorrected: NewValue(1),
+			},
+			retired:  RetiredPages{SingleBit: unavailable, DoubleBit: unavailable, Pending: unavailable},
+			power:    PowerReadings{Draw: NewValue(212.35), Limit: NewValue(300), RequestedLimit: NewValue(300), DefaultLimit: NewValue(300), MinLimit: NewValue(100), MaxLimit: NewValue(300)},
+			memTemp:  unavailable,
+			swPowCap: parseText("Active"),
+		},
+		{
+			name:     "r550 without ecc",
+			fixture:  "snapshot-r550.xml",
+			uuid:     testGpus[1].Uuid,
+			product:  "NVIDIA GeForce RTX 3060",
+			driver:   "550.54.15",
+			pcie:     PcieLink{GenCurrent: NewValue(1), GenMax: NewValue(4), WidthCurrent: NewValue(4), WidthMax: NewValue(16), ReplayCounter: NewValue(12)},
+			ecc:      EccErrors{Mode: unavailable, VolatileCorrected: unavailable, VolatileUncorrected: unavailable, AggregateCorrected: unavailable, AggregateUncorrected: unavailable},
+			retired:  RetiredPages{SingleBit: unavailable, DoubleBit: unavailable, Pending: unavailable},
+			power:    PowerReadings{Draw: NewValue(14.87), Limit: NewValue(170), RequestedLimit: NewValue(170), DefaultLimit: NewValue(170), MinLimit: NewValue(100), MaxLimit: NewValue(212)},
+			memTemp:  unavailable,
+			swPowCap: parseText("Not Active"),
+		},
+		{
+			name:    "r470 throttle reasons and power readings",
+			fixture: "snapshot-r470.xml",
+			uuid:    testGpus[0].Uuid,
+			product: "Tesla V100-PCIE-16GB",
+			driver:  "470.239.06",
+			pcie:    PcieLink{GenCurrent: NewValue(3), GenMax: NewValue(3), WidthCurrent: NewValue(16), WidthMax: NewValue(16), ReplayCounter: NewValue(0)},
+			ecc: EccErrors{
+				Mode:                 parseText("Enabled"),
+				VolatileCorrected:    NewValue(3),
+				VolatileUncorrected:  NewValue(0),
+				AggregateCorrected:   NewValue(57),
+				AggregateUncorrected: NewValue(2),
+			},
+			retired:  RetiredPages{SingleBit: NewValue(1), DoubleBit: NewValue(2), Pending: parseText("Yes")},
+			power:    PowerReadings{Draw: NewValue(38.51), Limit: NewValue(250), RequestedLimit: NewValue(250), DefaultLimit: NewValue(250), MinLimit: NewValue(100), MaxLimit: NewValue(250)},
+			memTemp:  NewValue(33),
+			swPowCap: parseText("Not Active"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshots, err := parseSnapshots([]byte(fixture(t, tt.fixture)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshot, found := snapshots[tt.uuid]
+			if !found {
+				t.Fatalf("no snapshot of %s", tt.uuid)
+			}
+
+			if snapshot.ProductName != tt.product || snapshot.DriverVersion.Text != tt.driver {
+				t.Errorf("product %q with driver %+v, want %q with %q", snapshot.ProductName, snapshot.DriverVersion, tt.product, tt.driver)
+			}
+			if snapshot.Pcie != tt.pcie {
+				t.Errorf("pcie = %+v, want %+v", snapshot.Pcie, tt.pcie)
+			}
+			if snapshot.Ecc != tt.ecc {
+				t.Errorf("ecc = %+v, want %+v", snapshot.Ecc, tt.ecc)
+			}
+			if snapshot.RetiredPages != tt.retired {
+				t.Errorf("retired pages = %+v, want %+v", snapshot.RetiredPages, tt.retired)
+			}
+			if snapshot.Power != tt.power {
+				t.Errorf("power = %+v, want %+v", snapshot.Power, tt.power)
+			}
+			if snapshot.Temperature.Memory != tt.memTemp {
+				t.Errorf("memory temperature = %+v, want %+v", snapshot.Temperature.Memory, tt.memTemp)
+			}
+			if reason := snapshot.ClockEventReasons["sw_power_cap"]; reason != tt.swPowCap {
+				t.Errorf("sw_power_cap = %+v, want %+v", reason, tt.swPowCap)
+			}
+		})
+	}
+}
+
+func TestParseSnapshotsInvalid(t *testing.T) {
+	if _, err := parseSnapshots([]byte("Failed to initialize NVML: Driver/library version mismatch")); err == nil {
+		t.Error("parseSnapshots accepted output that is not xml")
+	}
+}
@@ -0,0 +1,104 @@
+package gpuinfo
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MetricStats are the aggregates of a metric over the stats window.
+type MetricStats struct {
+	Min float64  `json:"min"`
+	Max float64  `json:"max"`
+	Avg float64  `json:"avg"`
+	P95 *float64 `json:"p95,omitempty"`
+}
+
+// Stats holds the MetricStats by source and key, e.g. Stats["dmon"]["pwr"]
+// for the metric "dmon.pwr", mirroring the layout of the state payload.
+type Stats map[string]map[string]MetricStats
+
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+// window keeps the numeric samples of one GPU over a rolling time window.
+type window struct {
+	length     time.Duration
+	percentile bool
+	samples    map[string][]sample
+}
+
+func newWindow(length time.Duration, percentile bool) *window {
+	return &window{
+		length:     length,
+		percentile: percentile,
+		samples:    make(map[string][]sample),
+	}
+}
+
+// add records the valid numeric values of metrics.
+func (w *window) add(now time.Time, metrics map[string]Value) {
+	for name, value := range metrics {
+		// Text and boolean values have no meaningful aggregates.
+		if !value.Valid() || value.Text != "" || value.Bool {
+			continue
+		}
+		w.samples[name] = append(w.samples[name], sample{at: now, value: value.Num})
+	}
+}
+
+// reset drops all samples.
+func (w *window) reset() {
+	w.samples = make(map[string][]sample)
+}
+
+// stats drops samples older than the window and aggregates the rest.
+func (w *window) stats(now time.Time) Stats {
+	stats := make(Stats)
+	cutoff := now.Add(-w.length)
+
+	for name, samples := range w.samples {
+		first := 0
+		for first < len(samples) && samples[first].at.Before(cutoff) {
+			first++
+		}
+		samples = samples[first:]
+		if len(samples) == 0 {
+			delete(w.samples, name)
+			continue
+		}
+		w.samples[name] = samples
+
+		source, key, _ := strings.Cut(name, ".")
+		if stats[source] == nil {
+			stats[source] = make(map[string]MetricStats)
+		}
+		stats[source][key] = w.aggregate(samples)
+	}
+	return stats
+}
+
+func (w *window) aggregate(samples []sample) MetricStats {
+	values := make([]float64, 0, len(samples))
+	sum := 0.0
+	for _, s := range samples {
+		values = append(values, s.value)
+		sum += s.value
+	}
+
+	stats := MetricStats{
+		Min: slices.Min(values),
+		Max: slices.Max(values),
+		Avg: sum / float64(len(values)),
+	}
+	if w.percentile {
+		// Nearest-rank percentile.
+		slices.Sort(values)
+		p95 := values[int(math.Ceil(0.95*float64(len(values))))-1]
+		stats.P95 = &p95
+	}
+	return stats
+}
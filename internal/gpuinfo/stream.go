@@ -0,0 +1,90 @@
+package gpuinfo
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// runStream runs a single long-running nvidia-smi process and passes every
+// line it prints to handle. It returns once the process exits, ctx is
+// cancelled or handle returns an error.
+func (n *NvidiaSmi) runStream(ctx context.Context, name string, wd *watchdog, args []string, handle func(line string) error) error {
+	logger := n.logger.With("process", name)
+	cmd := n.runner.Command(ctx, n.opts.Path, args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create %s stdout pipe: %w", name, err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create %s stderr pipe: %w", name, err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", name, err)
+	}
+
+	// Unblock the reader if the process is killed but its output stays open.
+	stop := context.AfterFunc(ctx, func() { _ = stdout.Close() })
+	defer stop()
+
+	// Goroutine for error readout, fatal conditions are kept for the exit error.
+	var fatal atomic.Pointer[string]
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			logger.Error("process error", "error", line)
+			if classifyMessage(line).Fatal() {
+				fatal.Store(&line)
+			}
+		}
+		if scanErr := scanner.Err(); scanErr != nil && ctx.Err() == nil {
+			logger.Error("failed to read stderr", "error", scanErr)
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		wd.Beat()
+
+		wd.Busy(true)
+		err := handle(scanner.Text())
+		wd.Busy(false)
+		if err != nil {
+			_ = cmd.Wait()
+			return err
+		}
+	}
+
+	scanErr := scanner.Err()
+	select {
+	case <-stderrDone:
+	case <-time.After(waitDelay):
+	}
+	waitErr := cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if scanErr != nil {
+		return fmt.Errorf("failed to read %s stdout: %w", name, scanErr)
+	}
+	if msg := fatal.Load(); msg != nil {
+		if waitErr != nil {
+			return fmt.Errorf("%s process exited with error: %w: %s", name, waitErr, *msg)
+		}
+		return fmt.Errorf("%s process exited: %s", name, *msg)
+	}
+	if waitErr != nil {
+		return fmt.Errorf("%s process exited with error: %w", name, waitErr)
+	}
+	return nil
+}
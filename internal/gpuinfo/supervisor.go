@@ -0,0 +1,141 @@
+package gpuinfo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minRestartBackoff = 1 * time.Second
+	maxRestartBackoff = 60 * time.Second
+	minStallTimeout   = 5 * time.Second
+)
+
+var errStalled = errors.New("no output received")
+
+// supervisor keeps a long-running nvidia-smi process alive. The process is
+// restarted with exponential backoff whenever it exits, and killed and
+// restarted when it stops producing output for longer than stallTimeout.
+type supervisor struct {
+	name         string
+	logger       *slog.Logger
+	stallTimeout time.Duration
+	restarts     atomic.Uint64
+	// onRestart is called with the error of every restart, if set.
+	onRestart func(err error)
+}
+
+func newSupervisor(name string, logger *slog.Logger, stallTimeout time.Duration) *supervisor {
+	return &supervisor{
+		name:         name,
+		logger:       logger,
+		stallTimeout: max(stallTimeout, minStallTimeout),
+	}
+}
+
+// setStallTimeout changes the stall timeout for the next call of run.
+func (s *supervisor) setStallTimeout(stallTimeout time.Duration) {
+	s.stallTimeout = max(stallTimeout, minStallTimeout)
+}
+
+// Restarts returns how often the process has been restarted.
+func (s *supervisor) Restarts() uint64 {
+	return s.restarts.Load()
+}
+
+// run calls fn until ctx is cancelled. fn has to call watchdog.Beat for
+// every line it reads, otherwise its context is cancelled as stalled.
+func (s *supervisor) run(ctx context.Context, fn func(ctx context.Context, wd *watchdog) error) {
+	backoff := minRestartBackoff
+
+	for {
+		runCtx, cancel := context.WithCancelCause(ctx)
+		wd := &watchdog{}
+		wd.Beat()
+
+		watchdogDone := make(chan struct{})
+		go func() {
+			defer close(watchdogDone)
+			wd.watch(runCtx, s.stallTimeout, func() { cancel(errStalled) })
+		}()
+
+		started := time.Now()
+		err := fn(runCtx, wd)
+		stalled := errors.Is(context.Cause(runCtx), errStalled)
+		cancel(nil)
+		<-watchdogDone
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		reason := "process exited"
+		switch {
+		case stalled:
+			reason = "process stalled"
+			err = fmt.Errorf("%s: %w", s.name, errStalled)
+		case err == nil:
+			err = fmt.Errorf("%s: end of output", s.name)
+		}
+
+		// A process that ran for a while counts as healthy again.
+		if time.Since(started) > maxRestartBackoff {
+			backoff = minRestartBackoff
+		}
+
+		count := s.restarts.Add(1)
+		s.logger.Warn("restarting "+s.name, "reason", reason, "error", err, "restart_count", count, "backoff", backoff)
+		if s.onRestart != nil {
+			s.onRestart(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRestartBackoff)
+	}
+}
+
+// watchdog tracks the last sign of life of a supervised process.
+type watchdog struct {
+	last atomic.Int64
+	busy atomic.Bool
+}
+
+// Beat records that the process produced output.
+func (w *watchdog) Beat() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+// Busy pauses stall detection while the reader itself is blocked,
+// e.g. while handing a sample to a slow consumer.
+func (w *watchdog) Busy(busy bool) {
+	w.busy.Store(busy)
+	w.Beat()
+}
+
+func (w *watchdog) watch(ctx context.Context, timeout time.Duration, onStall func()) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if w.busy.Load() {
+				continue
+			}
+			if time.Since(time.Unix(0, w.last.Load())) > timeout {
+				onStall()
+				return
+			}
+		}
+	}
+}
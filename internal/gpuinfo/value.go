@@ -0,0 +1,123 @@
+package gpuinfo
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// ValueStatus tells whether a metric value holds a real reading.
+type ValueStatus uint8
+
+const (
+	// ValueUnavailable marks a value nvidia-smi did not report (yet),
+	// e.g. "-", "[N/A]" or an unparsable field.
+	ValueUnavailable ValueStatus = iota
+	// ValueOK marks a real reading.
+	ValueOK
+	// ValueUnsupported marks a value the GPU or driver does not support.
+	ValueUnsupported
+)
+
+func (s ValueStatus) String() string {
+	switch s {
+	case ValueOK:
+		return "ok"
+	case ValueUnsupported:
+		return "unsupported"
+	default:
+		return "unavailable"
+	}
+}
+
+// Value is a metric reading that may be missing. The zero value is unavailable.
+// Missing values are encoded as JSON null. Text is set for string fields,
+// Bool marks boolean fields whose Num is 1 or 0 and which are encoded as JSON bool.
+type Value struct {
+	Num    float64
+	Text   string
+	Bool   bool
+	Status ValueStatus
+}
+
+// NewValue returns a valid reading of num.
+func NewValue(num float64) Value {
+	return Value{Num: num, Status: ValueOK}
+}
+
+// NewBool returns a valid boolean reading of b.
+func NewBool(b bool) Value {
+	v := Value{Bool: true, Status: ValueOK}
+	if b {
+		v.Num = 1
+	}
+	return v
+}
+
+// Valid reports whether v holds a real reading.
+func (v Value) Valid() bool {
+	return v.Status == ValueOK
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	if !v.Valid() {
+		return []byte("null"), nil
+	}
+	if v.Text != "" {
+		return json.Marshal(v.Text)
+	}
+	if v.Bool {
+		return strconv.AppendBool(nil, v.Num != 0), nil
+	}
+	return strconv.AppendFloat(nil, v.Num, 'f', -1, 64), nil
+}
+
+// missingValue classifies the nvidia-smi placeholders for values without a reading.
+func missingValue(val string) (Value, bool) {
+	switch val {
+	case "[Not Supported]", "Not Supported":
+		return Value{Status: ValueUnsupported}, true
+	case "", "-", "[N/A]", "N/A", "[Unknown Error]":
+		return Value{Status: ValueUnavailable}, true
+	}
+	return Value{}, false
+}
+
+// parseText parses a string nvidia-smi field.
+func parseText(s string) Value {
+	val := strings.TrimSpace(s)
+	if missing, ok := missingValue(val); ok {
+		return missing
+	}
+	return Value{Text: val, Status: ValueOK}
+}
+
+// parseBool parses a boolean nvidia-smi field such as "Active" or "Not Active".
+func parseBool(s string) Value {
+	val := strings.TrimSpace(s)
+	if missing, ok := missingValue(val); ok {
+		return missing
+	}
+
+	switch strings.ToLower(val) {
+	case "active", "yes", "enabled", "true", "1":
+		return NewBool(true)
+	case "not active", "no", "disabled", "false", "0":
+		return NewBool(false)
+	}
+	return Value{Status: ValueUnavailable}
+}
+
+// parseValue parses a numeric nvidia-smi field, keeping its fractional part.
+func parseValue(s string) Value {
+	val := strings.TrimSpace(s)
+	if missing, ok := missingValue(val); ok {
+		return missing
+	}
+
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return Value{Status: ValueUnavailable}
+	}
+	return NewValue(f)
+}
@@ -0,0 +1,292 @@
+package gpuinfo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// xidPollInterval is how often a regular log file is checked for new lines.
+	xidPollInterval = time.Second
+	// xidRetryInterval is the pause before the log is opened again after a failure.
+	xidRetryInterval = 30 * time.Second
+)
+
+// errLogRotated ends tailing a log file that was rotated or truncated.
+var errLogRotated = errors.New("log file was rotated")
+
+// XidError is an Xid error the driver logged for a GPU.
+type XidError struct {
+	Code        int       `json:"code"`
+	Description string    `json:"description"`
+	Message     string    `json:"message"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// XidErrors are the Xid errors of a GPU seen since the start.
+type XidErrors struct {
+	Count uint64    `json:"count"`
+	Last  *XidError `json:"last,omitempty"`
+}
+
+// xidPosition is how far the kernel log was read, so a restarted monitor
+// continues there instead of skipping the lines logged in between.
+type xidPosition struct {
+	// file and offset locate the next line of a regular log file.
+	file   os.FileInfo
+	offset int64
+	// seq is the sequence number of the last /dev/kmsg record read.
+	seq uint64
+}
+
+// kmsgSeq returns the sequence number of a /dev/kmsg record, e.g. 1523 of
+// "4,1523,1963017354,-;NVRM: ...".
+func kmsgSeq(record string) (uint64, bool) {
+	prefix, _, found := strings.Cut(record, ";")
+	if !found {
+		return 0, false
+	}
+	fields := strings.Split(prefix, ",")
+	if len(fields) < 2 {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	return seq, err == nil
+}
+
+// xidPattern matches the driver message, e.g.
+// "NVRM: Xid (PCI:0000:01:00): 79, pid='<unknown>', name=<unknown>, GPU has fallen off the bus."
+var xidPattern = regexp.MustCompile(`NVRM: Xid \(PCI:([0-9a-fA-F:.]+)\): (\d+)(?:,\s*(.*))?`)
+
+// xidDescriptions are the meanings of common Xid codes, see the NVIDIA Xid
+// errors documentation for the full list.
+var xidDescriptions = map[int]string{
+	8:   "GPU stopped processing",
+	13:  "Graphics engine exception",
+	31:  "GPU memory page fault",
+	32:  "Invalid or corrupted push buffer stream",
+	38:  "Driver firmware error",
+	43:  "GPU stopped processing",
+	45:  "Preemptive cleanup, due to previous errors",
+	48:  "Double bit ECC error",
+	61:  "Internal micro-controller breakpoint or warning",
+	62:  "Internal micro-controller halt",
+	63:  "ECC page retirement or row remapping recording event",
+	64:  "ECC page retirement or row remapping recording failure",
+	68:  "Video processor exception",
+	69:  "Graphics engine class error",
+	74:  "NVLink error",
+	79:  "GPU has fallen off the bus",
+	92:  "High single-bit ECC error rate",
+	94:  "Contained ECC error",
+	95:  "Uncontained ECC error",
+	109: "Context switch timeout error",
+	119: "GSP RPC timeout",
+	120: "GSP error",
+}
+
+// xidCritical are the Xid codes that point to failing hardware or a GPU
+// that needs a reset, the others are usually caused by the application.
+var xidCritical = map[int]bool{48: true, 62: true, 64: true, 74: true, 79: true, 92: true, 95: true, 119: true, 120: true}
+
+// Critical reports whether the Xid points to failing hardware or a GPU that needs a reset.
+func (x XidError) Critical() bool {
+	return xidCritical[x.Code]
+}
+
+// parseXidLine extracts the PCI bus id and the Xid from a kernel log line.
+// It accepts /dev/kmsg records as well as syslog lines.
+func parseXidLine(line string) (string, XidError, bool) {
+	match := xidPattern.FindStringSubmatch(line)
+	if match == nil {
+		return "", XidError{}, false
+	}
+	code, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", XidError{}, false
+	}
+
+	description, found := xidDescriptions[code]
+	if !found {
+		description = "Unknown Xid"
+	}
+	xid := XidError{
+		Code:        code,
+		Description: description,
+		Message:     strings.TrimSpace(match[3]),
+		Timestamp:   time.Now(),
+	}
+	return strings.ToLower(match[1]), xid, true
+}
+
+// xidGpu finds the GPU at the bus id of an Xid line. The driver omits the
+// function, e.g. "0000:01:00" for "0000:01:00.0", and sometimes the domain.
+func xidGpu(gpus []GPU, busId string) (GPU, bool) {
+	if strings.Count(busId, ":") == 1 {
+		busId = "0000:" + busId
+	}
+	busId = normalizeBusId(busId)
+	for _, gpu := range gpus {
+		if gpu.PciBusId != "" && strings.HasPrefix(gpu.PciBusId, busId) {
+			return gpu, true
+		}
+	}
+	return GPU{}, false
+}
+
+// runXidWatcher follows the kernel log at XidLog for Xid errors and sends
+// them to the channel of the affected GPU, keyed by UUID. Only lines written
+// after the first start are read, later starts continue where the previous
+// watcher stopped. Failures to read the log are passed to report
+// and the log is opened again after a pause.
+func (n *NvidiaSmi) runXidWatcher(ctx context.Context, gpus []GPU, outs map[string]chan XidError, report reportFunc) {
+	logger := n.logger.With("path", n.opts.XidLog)
+	fromStart := false
+	for {
+		err := n.tailXid(ctx, gpus, outs, fromStart)
+		if ctx.Err() != nil {
+			return
+		}
+		// All lines of a rotated log are new.
+		fromStart = errors.Is(err, errLogRotated)
+		if fromStart {
+			logger.Info("kernel log was rotated, reading it from the start")
+			continue
+		}
+		logger.Error("failed to read kernel log for xid errors", "error", err)
+		report(fmt.Errorf("xid watcher: %w", err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(xidRetryInterval):
+		}
+	}
+}
+
+// tailXid reads the lines added to the log until ctx is cancelled or
+// reading fails, or from the start of the log if fromStart is set. It
+// returns errLogRotated once a regular log file is rotated or truncated.
+func (n *NvidiaSmi) tailXid(ctx context.Context, gpus []GPU, outs map[string]chan XidError, fromStart bool) error {
+	file, err := os.Open(n.opts.XidLog)
+	if err != nil {
+		return err
+	}
+	// Closing the file unblocks a pending read of /dev/kmsg.
+	stop := context.AfterFunc(ctx, func() { file.Close() })
+	defer func() {
+		if stop() {
+			file.Close()
+		}
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	regular := info.Mode().IsRegular()
+
+	// Seeking to the end skips the messages logged before the first start,
+	// for /dev/kmsg as well as for regular files. Later starts continue at
+	// the position of the previous one, /dev/kmsg is read from its oldest
+	// record and the records seen before are skipped by sequence number.
+	n.mu.Lock()
+	position := n.xidPos
+	n.mu.Unlock()
+	var offset int64
+	switch {
+	case fromStart:
+		position = xidPosition{}
+	case regular && position.file != nil && os.SameFile(position.file, info) && info.Size() >= position.offset:
+		offset, err = file.Seek(position.offset, io.SeekStart)
+	case !regular && position.seq > 0:
+	default:
+		position = xidPosition{}
+		offset, err = file.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	var partial strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		offset += int64(len(line))
+		partial.WriteString(line)
+		if err == nil {
+			record := partial.String()
+			partial.Reset()
+			// Continuation lines of /dev/kmsg records have no sequence number.
+			if seq, ok := kmsgSeq(record); ok && !regular {
+				if seq <= position.seq {
+					continue
+				}
+				position.seq = seq
+			}
+			if !n.sendXid(ctx, gpus, record, outs) {
+				return nil
+			}
+
+			position.file, position.offset = info, offset
+			n.mu.Lock()
+			n.xidPos = position
+			n.mu.Unlock()
+			continue
+		}
+
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		// /dev/kmsg reports overwritten messages once, then continues.
+		case errors.Is(err, syscall.EPIPE):
+			n.logger.Warn("kernel log messages were overwritten before they were read")
+		case errors.Is(err, io.EOF) && regular:
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(xidPollInterval):
+			}
+			current, err := os.Stat(n.opts.XidLog)
+			if err != nil {
+				return err
+			}
+			if !os.SameFile(info, current) || current.Size() < offset {
+				return errLogRotated
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// sendXid sends the Xid error of line, if any, to the channel of its GPU.
+// It reports false once ctx is cancelled.
+func (n *NvidiaSmi) sendXid(ctx context.Context, gpus []GPU, line string, outs map[string]chan XidError) bool {
+	busId, xid, ok := parseXidLine(line)
+	if !ok {
+		return true
+	}
+	gpu, found := xidGpu(gpus, busId)
+	if !found {
+		n.logger.Warn("xid error for unknown gpu", "pci_bus_id", busId, "xid", xid.Code)
+		return true
+	}
+
+	n.logger.Warn("gpu reported xid error", "gpu_uuid", gpu.Uuid, "xid", xid.Code, "description", xid.Description)
+	select {
+	case outs[gpu.Uuid] <- xid:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
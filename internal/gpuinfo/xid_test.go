@@ -0,0 +1,300 @@
+package gpuinfo
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseXidLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		ok      bool
+		busId   string
+		code    int
+		message string
+	}{
+		{
+			name:    "kmsg record",
+			line:    "4,1523,1963017354,-;NVRM: Xid (PCI:0000:01:00): 79, pid='<unknown>', name=<unknown>, GPU has fallen off the bus.",
+			ok:      true,
+			busId:   "0000:01:00",
+			code:    79,
+			message: "pid='<unknown>', name=<unknown>, GPU has fallen off the bus.",
+		},
+		{
+			name:    "syslog line",
+			line:    "Oct 16 09:14:37 gpu-host kernel: [  968.104519] NVRM: Xid (PCI:0000:0A:00): 13, pid=4711, name=python3, Graphics SM Warp Exception",
+			ok:      true,
+			busId:   "0000:0a:00",
+			code:    13,
+			message: "pid=4711, name=python3, Graphics SM Warp Exception",
+		},
+		{
+			name:  "without message",
+			line:  "NVRM: Xid (PCI:01:00): 119",
+			ok:    true,
+			busId: "01:00",
+			code:  119,
+		},
+		{
+			name: "other driver message",
+			line: "NVRM: GPU at PCI:0000:02:00: GPU-66666666-7777-8888-9999-aaaaaaaaaaaa",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			busId, xid, ok := parseXidLine(tt.line)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if busId != tt.busId || xid.Code != tt.code || xid.Message != tt.message {
+				t.Errorf("got %q, %d, %q, want %q, %d, %q", busId, xid.Code, xid.Message, tt.busId, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+func TestXidGpu(t *testing.T) {
+	tests := []struct {
+		busId string
+		found bool
+		uuid  string
+	}{
+		{"0000:01:00", true, testGpus[0].Uuid},
+		{"00000000:02:00", true, testGpus[1].Uuid},
+		{"02:00", true, testGpus[1].Uuid},
+		{"0000:05:00", false, ""},
+	}
+	for _, tt := range tests {
+		gpu, found := xidGpu(testGpus, tt.busId)
+		if found != tt.found || gpu.Uuid != tt.uuid {
+			t.Errorf("xidGpu(%q) = %q, %v, want %q, %v", tt.busId, gpu.Uuid, found, tt.uuid, tt.found)
+		}
+	}
+}
+
+func TestXidCritical(t *testing.T) {
+	for code, want := range map[int]bool{13: false, 31: false, 48: true, 79: true, 95: true} {
+		if got := (XidError{Code: code}).Critical(); got != want {
+			t.Errorf("Critical() of xid %d = %v, want %v", code, got, want)
+		}
+	}
+}
+
+// receiveXid returns the next Xid error sent to any of outs.
+func receiveXid(t *testing.T, outs map[string]chan XidError) (string, XidError) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		for uuid, out := range outs {
+			select {
+			case xid := <-out:
+				return uuid, xid
+			default:
+			}
+		}
+		select {
+		case <-timeout:
+			t.Fatal("no xid error received")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestTailXid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kern.log")
+	if err := os.WriteFile(path, []byte(fixture(t, "kern.log")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	n := NewNvidiaSmi(nil, slog.New(slog.DiscardHandler), Options{XidLog: path})
+	outs := map[string]chan XidError{testGpus[0].Uuid: make(chan XidError), testGpus[1].Uuid: make(chan XidError)}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- n.tailXid(ctx, testGpus, outs, true)
+	}()
+
+	// The Xid of the unknown GPU at 0000:05:00 is dropped.
+	for _, want := range []struct {
+		uuid string
+		code int
+	}{{testGpus[1].Uuid, 13}, {testGpus[0].Uuid, 79}} {
+		uuid, xid := receiveXid(t, outs)
+		if uuid != want.uuid || xid.Code != want.code {
+			t.Errorf("got xid %d for %s, want %d for %s", xid.Code, uuid, want.code, want.uuid)
+		}
+	}
+
+	// Appended lines are picked up by polling.
+	appendLine(t, path, "Oct 16 09:40:03 gpu-host kernel: [ 2534.118604] NVRM: Xid (PCI:0000:01:00): 48, pid=4711, name=python3, An uncorrectable double bit error (DBE) has been detected on GPU in the framebuffer at partition 1, subpartition 0.")
+	uuid, xid := receiveXid(t, outs)
+	if uuid != testGpus[0].Uuid || xid.Code != 48 || xid.Description != "Double bit ECC error" {
+		t.Errorf("got xid %d (%s) for %s, want 48 for %s", xid.Code, xid.Description, uuid, testGpus[0].Uuid)
+	}
+
+	// A truncated log counts as rotated.
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if !errors.Is(err, errLogRotated) {
+			t.Errorf("tailXid returned %v, want errLogRotated", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("truncation was not detected")
+	}
+}
+
+func TestKmsgSeq(t *testing.T) {
+	tests := []struct {
+		record string
+		seq    uint64
+		ok     bool
+	}{
+		{"4,1523,1963017354,-;NVRM: Xid (PCI:0000:01:00): 79, GPU has fallen off the bus.", 1523, true},
+		{"6,7,1000,c;usb 1-1: new high-speed USB device", 7, true},
+		{" SUBSYSTEM=pci", 0, false},
+		{"Oct 16 09:31:12 gpu-host kernel: NVRM: Xid (PCI:0000:01:00): 79", 0, false},
+	}
+	for _, tt := range tests {
+		seq, ok := kmsgSeq(tt.record)
+		if seq != tt.seq || ok != tt.ok {
+			t.Errorf("kmsgSeq(%q) = %d, %v, want %d, %v", tt.record, seq, ok, tt.seq, tt.ok)
+		}
+	}
+}
+
+// appendLine appends line to the log file at path.
+func appendLine(t *testing.T, path, line string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXidSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kern.log")
+	if err := os.WriteFile(path, []byte(fixture(t, "kern.log")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runner := &replayRunner{replays: []replay{
+		{match: "dmon", stdout: fixture(t, "dmon.csv"), stream: true},
+		{match: "-i " + testGpus[0].Uuid, stdout: "35, 1024, 23552, 550.54.15, 30, P2\n"},
+		{match: "-i " + testGpus[1].Uuid, stdout: "0, 3, 12285, 550.54.15, [N/A], P8\n"},
+	}}
+	n := NewNvidiaSmi(runner, slog.New(slog.DiscardHandler), Options{
+		DmonInterval:    1,
+		DmonStallFactor: 5,
+		QueryInterval:   20 * time.Millisecond,
+		XidLog:          path,
+	})
+
+	// monitor runs a monitor until the first GPU has count Xid errors,
+	// calling started once the monitor is running.
+	monitor := func(count uint64, started func()) *XidErrors {
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		states, err := n.CombinedMonitor(ctx, testGpus)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-states
+		started()
+
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case state := <-states:
+				if state.Gpu.Uuid == testGpus[0].Uuid && state.Xid.Count == count {
+					cancel()
+					for range states {
+					}
+					return state.Xid
+				}
+			case <-timeout:
+				t.Fatalf("no state with %d xid errors", count)
+			}
+		}
+	}
+
+	// The lines logged before the first start are skipped.
+	xid := monitor(1, func() {
+		time.Sleep(100 * time.Millisecond)
+		appendLine(t, path, "Oct 16 09:40:03 gpu-host kernel: [ 2534.118604] NVRM: Xid (PCI:0000:01:00): 48, pid=4711, name=python3, An uncorrectable double bit error (DBE) has been detected on GPU in the framebuffer at partition 1, subpartition 0.")
+	})
+	if xid.Last.Code != 48 {
+		t.Errorf("last xid = %d, want 48", xid.Last.Code)
+	}
+
+	// A line logged while no monitor runs, e.g. during a rescan, is read by
+	// the next one, which keeps counting.
+	appendLine(t, path, "Oct 16 09:41:17 gpu-host kernel: [ 2608.310011] NVRM: Xid (PCI:0000:01:00): 94, pid=4711, name=python3, Contained: SM (0x1). RST: No, D-RST: No")
+	xid = monitor(2, func() {})
+	if xid.Last.Code != 94 {
+		t.Errorf("last xid = %d, want 94", xid.Last.Code)
+	}
+}
+
+func TestCombinedMonitorXidBetweenPublishTicks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kern.log")
+	if err := os.WriteFile(path, []byte(fixture(t, "kern.log")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runner := &replayRunner{replays: []replay{
+		{match: "dmon", stdout: fixture(t, "dmon.csv"), stream: true},
+		{match: "-i " + testGpus[0].Uuid, stdout: "35, 1024, 23552, 550.54.15, 30, P2\n"},
+		{match: "-i " + testGpus[1].Uuid, stdout: "0, 3, 12285, 550.54.15, [N/A], P8\n"},
+	}}
+	n := NewNvidiaSmi(runner, slog.New(slog.DiscardHandler), Options{
+		DmonInterval:    1,
+		DmonStallFactor: 5,
+		QueryInterval:   20 * time.Millisecond,
+		PublishInterval: time.Minute,
+		XidLog:          path,
+	})
+
+	// The watcher continues after the recorded log, as after a restart, and
+	// finds both Xids within the first publish interval.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.xidPos = xidPosition{file: info, offset: info.Size()}
+	appendLine(t, path, "Oct 16 09:40:03 gpu-host kernel: [ 2534.118604] NVRM: Xid (PCI:0000:01:00): 48, pid=4711, name=python3, An uncorrectable double bit error (DBE) has been detected on GPU in the framebuffer at partition 1, subpartition 0.")
+	appendLine(t, path, "Oct 16 09:40:04 gpu-host kernel: [ 2535.201377] NVRM: Xid (PCI:0000:01:00): 63, pid=4711, name=python3, Row Remapper: New row marked for remapping")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	states, err := n.CombinedMonitor(ctx, testGpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, code := range []int{48, 63} {
+		select {
+		case state := <-states:
+			if state.Gpu.Uuid != testGpus[0].Uuid || state.Xid.Count != uint64(i+1) || state.Xid.Last.Code != code {
+				t.Errorf("state %d: xid %+v of %s, want count %d with xid %d", i, state.Xid, state.Gpu.Uuid, i+1, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no state for xid %d", code)
+		}
+	}
+}
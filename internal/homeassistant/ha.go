@@ -3,6 +3,8 @@ package homeassistant
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/rbnhln/smi2mqtt/internal/gpuinfo"
 	"github.com/rbnhln/smi2mqtt/internal/mqtt"
@@ -14,6 +16,53 @@ type SensorDescription struct {
 	DeviceClass string
 	Unit        string
 	ValuePath   string
+	// StateClass overrides the default "measurement" of sensors with a unit.
+	StateClass string
+	// Binary publishes the sensor as binary_sensor, e.g. for boolean query fields.
+	Binary bool
+	// EntityCategory is empty for primary entities, or "diagnostic".
+	EntityCategory string
+	// Topic is the GPU topic the sensor reads, "state" if empty.
+	Topic string
+}
+
+// component returns the Home Assistant entity platform of the sensor.
+func (d SensorDescription) component() string {
+	if d.Binary {
+		return "binary_sensor"
+	}
+	return "sensor"
+}
+
+// ErrorSensorDescription describes the last collector error of a GPU.
+var ErrorSensorDescription = SensorDescription{Name: "Last Error", ValuePath: "message", Topic: "error"}
+
+// PowerStateSensorDescription describes the runtime PM state of a GPU.
+var PowerStateSensorDescription = SensorDescription{Name: "Runtime Power State", ValuePath: "power_state"}
+
+// PcieLinkDegradedSensorDescription tells whether the PCIe link of a GPU stays reduced under load.
+var PcieLinkDegradedSensorDescription = SensorDescription{Name: "PCIe Link Degraded", DeviceClass: "problem", ValuePath: "pcie_link_degraded", Binary: true}
+
+// PowerLimitPercentSensorDescription describes the power draw in percent of the enforced power limit.
+var PowerLimitPercentSensorDescription = SensorDescription{Name: "Power (% of Limit)", Unit: "%", ValuePath: "query." + gpuinfo.PowerLimitPercentKey}
+
+// XidSensorDescription counts the Xid errors of a GPU.
+var XidSensorDescription = SensorDescription{Name: "Xid Errors", ValuePath: "xid.count", StateClass: "total_increasing"}
+
+// MemorySensorDescriptions describe the memory health of a GPU, keyed by their unique suffix.
+var MemorySensorDescriptions = map[string]SensorDescription{
+	"memory_health":               {Name: "Memory Health", ValuePath: "memory.state"},
+	"ecc_volatile_corrected":      {Name: "ECC Corrected (volatile)", ValuePath: "memory.ecc.volatile_corrected", StateClass: "total_increasing"},
+	"ecc_volatile_uncorrected":    {Name: "ECC Uncorrected (volatile)", ValuePath: "memory.ecc.volatile_uncorrected", StateClass: "total_increasing"},
+	"ecc_aggregate_corrected":     {Name: "ECC Corrected (aggregate)", ValuePath: "memory.ecc.aggregate_corrected", StateClass: "total_increasing"},
+	"ecc_aggregate_uncorrected":   {Name: "ECC Uncorrected (aggregate)", ValuePath: "memory.ecc.aggregate_uncorrected", StateClass: "total_increasing"},
+	"retired_pages_single_bit":    {Name: "Retired Pages (single bit)", ValuePath: "memory.retired_pages.single_bit", StateClass: "total_increasing"},
+	"retired_pages_double_bit":    {Name: "Retired Pages (double bit)", ValuePath: "memory.retired_pages.double_bit", StateClass: "total_increasing"},
+	"retired_pages_pending":       {Name: "Page Retirement Pending", DeviceClass: "problem", ValuePath: "memory.retired_pages.pending", Binary: true},
+	"remapped_rows_correctable":   {Name: "Remapped Rows (correctable)", ValuePath: "memory.remapped_rows.correctable", StateClass: "total_increasing"},
+	"remapped_rows_uncorrectable": {Name: "Remapped Rows (uncorrectable)", ValuePath: "memory.remapped_rows.uncorrectable", StateClass: "total_increasing"},
+	"remapped_rows_pending":       {Name: "Row Remapping Pending", DeviceClass: "problem", ValuePath: "memory.remapped_rows.pending", Binary: true},
+	"remapped_rows_failure":       {Name: "Row Remapping Failed", DeviceClass: "problem", ValuePath: "memory.remapped_rows.failure", Binary: true},
 }
 
 // Home Assistant device descriptor for one GPU.
@@ -26,44 +75,112 @@ type Device struct {
 
 // ConfigPayload is the main structure for HA discovery messages.
 type ConfigPayload struct {
-	Device            Device `json:"device"`
-	Name              string `json:"name"`
-	DeviceClass       string `json:"device_class,omitempty"`
-	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
-	ValueTemplate     string `json:"value_template"`
-	UniqueID          string `json:"unique_id"`
-	StateClass        string `json:"state_class,omitempty"`
-	ExpireAfter       int    `json:"expire_after"`
-	EnabledByDefault  bool   `json:"enabled_by_default"`
-	AvailabilityTopic string `json:"availability_topic"`
-	StateTopic        string `json:"state_topic"`
+	Device            Device         `json:"device"`
+	Name              string         `json:"name"`
+	DeviceClass       string         `json:"device_class,omitempty"`
+	UnitOfMeasurement string         `json:"unit_of_measurement,omitempty"`
+	ValueTemplate     string         `json:"value_template"`
+	UniqueID          string         `json:"unique_id"`
+	StateClass        string         `json:"state_class,omitempty"`
+	EntityCategory    string         `json:"entity_category,omitempty"`
+	ExpireAfter       int            `json:"expire_after"`
+	EnabledByDefault  bool           `json:"enabled_by_default"`
+	Availability      []Availability `json:"availability"`
+	AvailabilityMode  string         `json:"availability_mode"`
+	StateTopic        string         `json:"state_topic"`
+}
+
+// Availability is one availability topic of an entity.
+type Availability struct {
+	Topic string `json:"topic"`
 }
 
-// SensorDescriptions are package wide available for testing
-var SensorDescriptions = map[string]SensorDescription{
-	"pwr":     {Name: "Power Usage", DeviceClass: "power", Unit: "W", ValuePath: "dmon.pwr"},
-	"gtemp":   {Name: "GPU Temp", DeviceClass: "temperature", Unit: "°C", ValuePath: "dmon.gtemp"},
-	"mtemp":   {Name: "Memory Temp", DeviceClass: "temperature", Unit: "°C", ValuePath: "dmon.mtemp"},
-	"sm":      {Name: "SM Util", Unit: "%", ValuePath: "dmon.sm"},
-	"mem":     {Name: "Memory Util", Unit: "%", ValuePath: "dmon.mem"},
-	"enc":     {Name: "Encoder Util", Unit: "%", ValuePath: "dmon.enc"},
-	"dec":     {Name: "Decoder Util", Unit: "%", ValuePath: "dmon.dec"},
-	"jpg":     {Name: "JPG Util", Unit: "%", ValuePath: "dmon.jpg"},
-	"ofa":     {Name: "Optical Flow Util", Unit: "%", ValuePath: "dmon.ofa"},
-	"mclk":    {Name: "Memory Clock", DeviceClass: "frequency", Unit: "MHz", ValuePath: "dmon.mclk"},
-	"pclk":    {Name: "Processor Clock", DeviceClass: "frequency", Unit: "MHz", ValuePath: "dmon.pclk"},
-	"pci":     {Name: "PCI Throughput", DeviceClass: "data_rate", Unit: "MB/s", ValuePath: "dmon.pci"},
-	"rxpci":   {Name: "PCI RX", DeviceClass: "data_rate", Unit: "MB/s", ValuePath: "dmon.rxpci"},
-	"txpci":   {Name: "PCI TX", DeviceClass: "data_rate", Unit: "MB/s", ValuePath: "dmon.txpci"},
-	"utilgpu": {Name: "GPU Utilization", Unit: "%", ValuePath: "query.utilgpu"},
-	"memused": {Name: "Memory Used", DeviceClass: "data_size", Unit: "MiB", ValuePath: "query.memused"},
-	"memfree": {Name: "Memory Free", DeviceClass: "data_size", Unit: "MiB", ValuePath: "query.memfree"},
-	"drivver": {Name: "Driver Version", ValuePath: "query.drivver"},
-	"fanspe":  {Name: "Fan Speed", Unit: "%", ValuePath: "query.fanspe"},
-	"pstat":   {Name: "Power State", ValuePath: "query.pstat"},
+// DmonSensorDescriptions describe the dmon columns, keyed by column name.
+// They are package wide available for testing.
+var DmonSensorDescriptions = map[string]SensorDescription{
+	"pwr":   {Name: "Power Usage", DeviceClass: "power", Unit: "W", ValuePath: "dmon.pwr"},
+	"gtemp": {Name: "GPU Temp", DeviceClass: "temperature", Unit: "°C", ValuePath: "dmon.gtemp"},
+	"mtemp": {Name: "Memory Temp", DeviceClass: "temperature", Unit: "°C", ValuePath: "dmon.mtemp"},
+	"sm":    {Name: "SM Util", Unit: "%", ValuePath: "dmon.sm"},
+	"mem":   {Name: "Memory Util", Unit: "%", ValuePath: "dmon.mem"},
+	"enc":   {Name: "Encoder Util", Unit: "%", ValuePath: "dmon.enc"},
+	"dec":   {Name: "Decoder Util", Unit: "%", ValuePath: "dmon.dec"},
+	"jpg":   {Name: "JPG Util", Unit: "%", ValuePath: "dmon.jpg"},
+	"ofa":   {Name: "Optical Flow Util", Unit: "%", ValuePath: "dmon.ofa"},
+	"mclk":  {Name: "Memory Clock", DeviceClass: "frequency", Unit: "MHz", ValuePath: "dmon.mclk"},
+	"pclk":  {Name: "Processor Clock", DeviceClass: "frequency", Unit: "MHz", ValuePath: "dmon.pclk"},
+	"pci":   {Name: "PCI Throughput", DeviceClass: "data_rate", Unit: "MB/s", ValuePath: "dmon.pci"},
+	"rxpci": {Name: "PCI RX", DeviceClass: "data_rate", Unit: "MB/s", ValuePath: "dmon.rxpci"},
+	"txpci": {Name: "PCI TX", DeviceClass: "data_rate", Unit: "MB/s", ValuePath: "dmon.txpci"},
 }
 
-func PublishConfigs(client mqtt.Publisher, gpus []gpuinfo.GPU, baseTopic string) error {
+// SensorDescriptions returns the sensors for the selected dmon groups
+// and one sensor per query field, keyed by their unique suffix.
+func SensorDescriptions(dmonGroups string, fields []gpuinfo.QueryField) map[string]SensorDescription {
+	sensors := make(map[string]SensorDescription)
+	for _, column := range gpuinfo.DmonColumns(dmonGroups) {
+		if desc, found := DmonSensorDescriptions[column]; found {
+			sensors[column] = desc
+		}
+	}
+
+	sensors["error"] = ErrorSensorDescription
+
+	for _, field := range fields {
+		key := field.PayloadKey()
+		sensors[key] = SensorDescription{
+			Name:           field.DisplayName(),
+			DeviceClass:    field.DeviceClass,
+			Unit:           field.Unit,
+			ValuePath:      "query." + key,
+			StateClass:     field.StateClass,
+			Binary:         field.Type == gpuinfo.FieldBool,
+			EntityCategory: field.EntityCategory,
+		}
+	}
+	return sensors
+}
+
+// StatsSensorDescriptions returns min, max, avg and optionally p95 sensors
+// for each of metrics, e.g. "Power Usage (max 1m)" for "dmon.pwr". They are
+// derived from the sensor in sensors that reads the metric.
+func StatsSensorDescriptions(sensors map[string]SensorDescription, metrics []string, window time.Duration, percentile bool) map[string]SensorDescription {
+	aggregates := []string{"min", "max", "avg"}
+	if percentile {
+		aggregates = append(aggregates, "p95")
+	}
+
+	stats := make(map[string]SensorDescription)
+	for key, desc := range sensors {
+		if !slices.Contains(metrics, desc.ValuePath) {
+			continue
+		}
+		for _, aggregate := range aggregates {
+			stats[key+"_"+aggregate] = SensorDescription{
+				Name:        fmt.Sprintf("%s (%s %s)", desc.Name, aggregate, formatWindow(window)),
+				DeviceClass: desc.DeviceClass,
+				Unit:        desc.Unit,
+				ValuePath:   fmt.Sprintf("stats.%s.%s", desc.ValuePath, aggregate),
+			}
+		}
+	}
+	return stats
+}
+
+// formatWindow renders whole minutes and hours in short form, e.g. "1m" instead of "1m0s".
+func formatWindow(window time.Duration) string {
+	switch {
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	}
+	return window.String()
+}
+
+// PublishConfigs publishes the discovery configs of sensors for gpus. State
+// sensors expire after expireAfter seconds without a state, 0 disables it.
+func PublishConfigs(client mqtt.Publisher, gpus []gpuinfo.GPU, baseTopic string, sensors map[string]SensorDescription, expireAfter int) error {
 	availabilityTopic := fmt.Sprintf("%s/availability", baseTopic)
 
 	for _, gpu := range gpus {
@@ -73,28 +190,47 @@ func PublishConfigs(client mqtt.Publisher, gpus []gpuinfo.GPU, baseTopic string)
 			Manufacturer: "NVIDIA",
 			Model:        gpu.Name,
 		}
-		stateTopic := fmt.Sprintf("%s/%s/state", baseTopic, gpu.Uuid)
+		gpuAvailabilityTopic := fmt.Sprintf("%s/%s/availability", baseTopic, gpu.Uuid)
 
-		for key, desc := range SensorDescriptions {
-			configTopic := fmt.Sprintf("homeassistant/sensor/%s_%s/config", gpu.Uuid, key)
+		for key, desc := range sensors {
+			configTopic := configTopic(desc, gpu, key)
+			topic := desc.Topic
+			if topic == "" {
+				topic = "state"
+			}
 
 			payload := ConfigPayload{
 				Device:            device,
 				Name:              desc.Name,
 				DeviceClass:       desc.DeviceClass,
 				UnitOfMeasurement: desc.Unit,
-				ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", desc.ValuePath),
+				ValueTemplate:     valueTemplate(desc),
 				UniqueID:          fmt.Sprintf("%s_%s", gpu.Uuid, key),
 				StateClass:        "measurement",
-				ExpireAfter:       60,
+				EntityCategory:    desc.EntityCategory,
+				ExpireAfter:       expireAfter,
 				EnabledByDefault:  true,
-				AvailabilityTopic: availabilityTopic,
-				StateTopic:        stateTopic,
+				Availability:      []Availability{{Topic: availabilityTopic}},
+				AvailabilityMode:  "all",
+				StateTopic:        fmt.Sprintf("%s/%s/%s", baseTopic, gpu.Uuid, topic),
+			}
+
+			// Metrics also need the GPU itself to be online, the error stays
+			// available to tell why it is not.
+			if topic == "state" {
+				payload.Availability = append(payload.Availability, Availability{Topic: gpuAvailabilityTopic})
 			}
 
-			if desc.Unit == "" {
+			switch {
+			case desc.StateClass != "":
+				payload.StateClass = desc.StateClass
+			case desc.Unit == "" || desc.Binary:
 				payload.StateClass = ""
 			}
+			// Retained topics other than the state are updated rarely and must not expire.
+			if topic != "state" {
+				payload.ExpireAfter = 0
+			}
 
 			payloadBytes, err := json.Marshal(payload)
 			if err != nil {
@@ -113,3 +249,30 @@ func PublishConfigs(client mqtt.Publisher, gpus []gpuinfo.GPU, baseTopic string)
 
 	return nil
 }
+
+// RemoveConfigs deletes the discovery configs of gpus, which removes their
+// entities from Home Assistant.
+func RemoveConfigs(client mqtt.Publisher, gpus []gpuinfo.GPU, sensors map[string]SensorDescription) error {
+	for _, gpu := range gpus {
+		for key, desc := range sensors {
+			if err := client.Publish("", configTopic(desc, gpu, key), true); err != nil {
+				return fmt.Errorf("failed to remove config for %s_%s: %w", gpu.Uuid, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func configTopic(desc SensorDescription, gpu gpuinfo.GPU, key string) string {
+	return fmt.Sprintf("homeassistant/%s/%s_%s/config", desc.component(), gpu.Uuid, key)
+}
+
+// valueTemplate renders the value at the path of desc. Missing or null values
+// render as "None", which Home Assistant shows as unknown instead of a fake
+// zero. Binary sensors render ON or OFF.
+func valueTemplate(desc SensorDescription) string {
+	if desc.Binary {
+		return fmt.Sprintf("{%% set v = value_json.%s | default(None) %%}{{ 'None' if v is none else ('ON' if v else 'OFF') }}", desc.ValuePath)
+	}
+	return fmt.Sprintf("{{ value_json.%s | default(None) }}", desc.ValuePath)
+}
@@ -11,10 +11,21 @@ import (
 
 const reconnectWarnThreshold = 10
 
+// StatusOffline is the service status published to <topic>/status on
+// shutdown and by the broker as last will when the connection drops.
+const StatusOffline = "offline"
+
 type Publisher interface {
 	Publish(payload string, topic string, retained bool) error
 }
 
+// Client is a Publisher with a broker connection, implemented by MqttClient.
+type Client interface {
+	Publisher
+	Connect() error
+	Disconnect()
+}
+
 type MqttClient struct {
 	client mqtt.Client
 	logger *slog.Logger
@@ -22,12 +33,18 @@ type MqttClient struct {
 
 	reconnectAttempts atomic.Uint32
 	everConnected     atomic.Bool
+
+	// status is the last service status published to statusTopic, restored
+	// after a reconnect as the will replaced it.
+	statusTopic string
+	status      atomic.Pointer[string]
 }
 
 func New(cfg *config.Config, logger *slog.Logger) (*MqttClient, error) {
 	mqttClient := &MqttClient{
-		logger: logger,
-		config: cfg,
+		logger:      logger,
+		config:      cfg,
+		statusTopic: cfg.Topic + "/status",
 	}
 
 	opts := mqtt.NewClientOptions()
@@ -39,6 +56,7 @@ func New(cfg *config.Config, logger *slog.Logger) (*MqttClient, error) {
 	opts.SetConnectRetry(true)
 	opts.SetConnectTimeout(5 * time.Second)
 	opts.SetConnectRetryInterval(2 * time.Second)
+	opts.SetWill(mqttClient.statusTopic, StatusOffline, 0, true)
 	opts.OnConnect = mqttClient.connectHandler
 	opts.OnConnectionLost = mqttClient.connectionLostHandler
 	opts.SetReconnectingHandler(mqttClient.reconnectingHandler)
@@ -69,6 +87,12 @@ func (c *MqttClient) connectHandler(client mqtt.Client) {
 
 	c.everConnected.Store(true)
 	c.reconnectAttempts.Store(0)
+
+	if status := c.status.Load(); status != nil {
+		if err := c.Publish(*status, c.statusTopic, true); err != nil {
+			c.logger.Warn("Failed to restore status after reconnect", "status", *status, "error", err)
+		}
+	}
 }
 
 func (c *MqttClient) connectionLostHandler(client mqtt.Client, err error) {
@@ -85,6 +109,9 @@ func (c *MqttClient) reconnectingHandler(client mqtt.Client, opts *mqtt.ClientOp
 }
 
 func (c *MqttClient) Publish(message string, topic string, retain bool) error {
+	if retain && topic == c.statusTopic {
+		c.status.Store(&message)
+	}
 	token := c.client.Publish(topic, 0, retain, message)
 	token.Wait()
 	return token.Error()